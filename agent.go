@@ -1,12 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/42wim/ssh-agentx/yubikey"
 	"github.com/spf13/viper"
@@ -18,31 +29,104 @@ var (
 	yubiSignExtension      = "ssh-yubi-sign@42wim"
 	yubiPublicKeyExtension = "ssh-yubi-publickey@42wim"
 	yubiSetSlotExtension   = "ssh-yubi-setslot@42wim"
+	yubiWindowExtension    = "ssh-yubi-window@42wim"
 	gpgSignExtension       = "ssh-gpg-sign@42wim"
+	infoExtension          = "ssh-agentx-info@42wim"
+	approvalExtension      = "ssh-agentx-approval@42wim"
 )
 
+// agentInfo is returned by the ssh-agentx-info@42wim extension.
+type agentInfo struct {
+	Pid    int    `json:"pid"`
+	Socket string `json:"socket"`
+}
+
+var errLocked = errors.New("agent: locked")
+
 type SSHAgent struct {
 	agent.ExtendedAgent
-	gpgkeys    []GPGKey
-	v          *viper.Viper
-	mutex      sync.RWMutex
-	yubisigner crypto.Signer
-	yubikey    *yubikey.YubiKey
+	gpgkeys         []GPGKey
+	keys            map[string]*keyInfo
+	lazykeys        []*lazyKey
+	policy          []policyRule
+	audit           *auditLog
+	ratelimiter     *rateLimiter
+	approvals       *approvalQueue
+	metrics         *metrics
+	metricsListener net.Listener
+	keysMutex       sync.RWMutex
+	locked          bool
+	store           *keyStore
+	opts            *options
+	socket          string
+	v               *viper.Viper
+	config          []byte // contents of the config file in use
+	reloadMutex     sync.Mutex
+	mutex           sync.RWMutex
+	yubisigner      crypto.Signer
+	yubikey         *yubikey.YubiKey
+	yubiWindow      time.Time
+	yubiWindowTimer *time.Timer
+}
+
+// keyInfo keeps the constraints of an added key that the keyring doesn't
+// enforce itself.
+type keyInfo struct {
+	added        agent.AddedKey
+	pk           ssh.PublicKey
+	comment      string
+	confirm      bool
+	destinations []destConstraint
+	expire       *time.Time
 }
 
 func (s *SSHAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	res, err := s.handleExtension(s.newConnAgent(nil), extensionType, contents)
+	if extensionType == gpgSignExtension && isGPGSignV2(contents) {
+		return gpgSignReply(res, err), nil
+	}
+
+	return res, err
+}
+
+// handleExtension handles the extension request that came in on the
+// connection c, of which the peer is nil when the client is unknown.
+func (s *SSHAgent) handleExtension(c *connAgent, extensionType string, contents []byte) ([]byte, error) {
+	peer := c.requestPeer()
+
+	switch extensionType {
+	case gpgSignExtension, yubiSignExtension, yubiPublicKeyExtension, yubiSetSlotExtension, yubiWindowExtension:
+		if s.isLocked() {
+			log.Println("refusing", extensionType, "request from", peer.String()+": agent is locked")
+			return nil, errLocked
+		}
+	}
+
+	switch extensionType {
+	case yubiPublicKeyExtension, yubiSetSlotExtension, yubiWindowExtension, infoExtension:
+		req := s.extensionPolicyRequest(peer, extensionType, contents)
+
+		if err := s.authorize(req); err != nil {
+			return nil, err
+		}
+
+		if err := s.chargeRateLimit(req); err != nil {
+			return nil, err
+		}
+	}
+
 	switch extensionType {
 	case gpgSignExtension:
-		return s.handleGPGSign(contents)
+		return s.handleGPGSign(c, contents)
 	case yubiSignExtension:
 		if s.v.GetBool("yubikey.enablelog") {
-			log.Println("got", extensionType, "request to sign")
+			log.Println("got", extensionType, "request to sign from", peer)
 		}
 
-		return s.handleYubiSign(contents)
+		return s.handleYubiSign(peer, contents)
 	case yubiPublicKeyExtension:
 		if s.v.GetBool("yubikey.enablelog") {
-			log.Println("got", extensionType, "request for publickey")
+			log.Println("got", extensionType, "request for publickey from", peer)
 		}
 
 		return x509.MarshalPKIXPublicKey(s.yubisigner.Public())
@@ -53,9 +137,9 @@ func (s *SSHAgent) Extension(extensionType string, contents []byte) ([]byte, err
 		if s.yubikey.GetSlot() == string(contents) {
 			if s.v.GetBool("yubikey.enablelog") {
 				if string(contents) == "" {
-					log.Println("got", extensionType, "setting slot to default slot (9a) but already set.")
+					log.Println("got", extensionType, "from", peer, "setting slot to default slot (9a) but already set.")
 				} else {
-					log.Println("got", extensionType, "setting slot to", string(contents), "but already set.")
+					log.Println("got", extensionType, "from", peer, "setting slot to", string(contents), "but already set.")
 				}
 			}
 
@@ -73,32 +157,253 @@ func (s *SSHAgent) Extension(extensionType string, contents []byte) ([]byte, err
 
 		if s.v.GetBool("yubikey.enablelog") {
 			if string(contents) == "" {
-				log.Println("got", extensionType, "setting slot to default slot (9a)")
+				log.Println("got", extensionType, "from", peer, "setting slot to default slot (9a)")
 			} else {
-				log.Println("got", extensionType, "setting slot to", string(contents))
+				log.Println("got", extensionType, "from", peer, "setting slot to", string(contents))
 			}
 			log.Println("got", extensionType, "new crypto signers set")
 		}
 
 		return nil, nil
+	case yubiWindowExtension:
+		return nil, s.handleYubiWindow(peer, contents)
+	case approvalExtension:
+		return s.handleApproval(peer, contents)
+	case infoExtension:
+		return json.Marshal(agentInfo{
+			Pid:    os.Getpid(),
+			Socket: s.socket,
+		})
 	default:
 		return nil, agent.ErrExtensionUnsupported
 	}
 }
 
 func (s *SSHAgent) Add(key agent.AddedKey) error {
-	s.handleGPGImport(key.PrivateKey, key.Comment)
-	return s.ExtendedAgent.Add(key)
+	pk, err := addedKeyPublicKey(key)
+	if err != nil {
+		return err
+	}
+
+	if key.LifetimeSecs == 0 && s.opts.lifetime > 0 {
+		key.LifetimeSecs = uint32(s.opts.lifetime.Seconds())
+	}
+
+	info := &keyInfo{
+		added:   key,
+		pk:      pk,
+		comment: key.Comment,
+		confirm: key.ConfirmBeforeUse,
+	}
+
+	if key.LifetimeSecs > 0 {
+		t := time.Now().Add(time.Duration(key.LifetimeSecs) * time.Second)
+		info.expire = &t
+
+		// drop the derived GPG identities as soon as the key expires, the
+		// keyring itself only expires keys when they are used.
+		time.AfterFunc(time.Until(t), s.expireKeys)
+	}
+
+	for _, c := range key.ConstraintExtensions {
+		switch c.ExtensionName {
+		case restrictDestinationExtension:
+			if info.destinations != nil {
+				return fmt.Errorf("duplicate %s constraint", c.ExtensionName)
+			}
+
+			info.destinations, err = parseDestConstraints(c.ExtensionDetails)
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported constraint %s", c.ExtensionName)
+		}
+	}
+
+	// refuse the key before it replaces a copy that is already loaded
+	if err := s.checkGPGFingerprint(pk, key.Comment); err != nil {
+		return err
+	}
+
+	if err := s.ExtendedAgent.Add(key); err != nil {
+		return err
+	}
+
+	s.keysMutex.Lock()
+	s.keys[string(pk.Marshal())] = info
+	s.keysMutex.Unlock()
+
+	if err := s.handleGPGImport(pk); err != nil {
+		log.Println("deriving GPG key failed:", err)
+	}
+
+	s.saveStore()
+
+	return nil
 }
 
 func (s *SSHAgent) Remove(key ssh.PublicKey) error {
-	s.handleGPGRemove(key)
-	return s.ExtendedAgent.Remove(key)
+	// the keyring refuses to remove keys while it is locked, keep the
+	// constraints until the key is really gone.
+	if err := s.ExtendedAgent.Remove(key); err != nil {
+		return err
+	}
+
+	s.keysMutex.Lock()
+	delete(s.keys, string(key.Marshal()))
+	s.keysMutex.Unlock()
+
+	// rederive the GPG key from a certificate of the key that is left
+	s.handleGPGImport(key)
+
+	s.saveStore()
+
+	return nil
 }
 
 func (s *SSHAgent) RemoveAll() error {
+	if err := s.ExtendedAgent.RemoveAll(); err != nil {
+		return err
+	}
+
+	s.keysMutex.Lock()
 	s.gpgkeys = []GPGKey{}
-	return s.ExtendedAgent.RemoveAll()
+	s.keys = make(map[string]*keyInfo)
+	s.keysMutex.Unlock()
+
+	s.saveStore()
+
+	return nil
+}
+
+func (s *SSHAgent) List() ([]*agent.Key, error) {
+	s.expireKeys()
+
+	keys, err := s.ExtendedAgent.List()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.listLazyKeys(keys), nil
+}
+
+// Lock locks the keyring and suspends the gpg and yubikey extensions until
+// the agent is unlocked again.
+func (s *SSHAgent) Lock(passphrase []byte) error {
+	if err := s.ExtendedAgent.Lock(passphrase); err != nil {
+		return err
+	}
+
+	s.keysMutex.Lock()
+	s.locked = true
+	s.keysMutex.Unlock()
+
+	log.Println("agent locked")
+
+	return nil
+}
+
+func (s *SSHAgent) Unlock(passphrase []byte) error {
+	if err := s.ExtendedAgent.Unlock(passphrase); err != nil {
+		return err
+	}
+
+	s.keysMutex.Lock()
+	s.locked = false
+	s.keysMutex.Unlock()
+
+	log.Println("agent unlocked")
+
+	return nil
+}
+
+func (s *SSHAgent) isLocked() bool {
+	s.keysMutex.RLock()
+	defer s.keysMutex.RUnlock()
+
+	return s.locked
+}
+
+// expireKeys removes the keys (and their GPG identities) whose lifetime has
+// passed.
+func (s *SSHAgent) expireKeys() {
+	var expired []ssh.PublicKey
+
+	s.keysMutex.RLock()
+	for _, info := range s.keys {
+		if info.expire != nil && time.Now().After(*info.expire) {
+			expired = append(expired, info.pk)
+		}
+	}
+	s.keysMutex.RUnlock()
+
+	for _, pk := range expired {
+		log.Println("key", ssh.FingerprintSHA256(pk), "expired")
+
+		s.keysMutex.Lock()
+		delete(s.keys, string(pk.Marshal()))
+		s.keysMutex.Unlock()
+
+		s.handleGPGImport(pk)
+	}
+
+	if len(expired) > 0 {
+		s.saveStore()
+	}
+}
+
+func (s *SSHAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return s.SignWithFlags(key, data, 0)
+}
+
+func (s *SSHAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	return s.signKey(policyRequest{request: policySignRequest, pk: key}, key, data, flags)
+}
+
+// signKey signs data with key once it is confirmed and counts req against the
+// rate limits.
+func (s *SSHAgent) signKey(req policyRequest, key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if lk := s.findLazyKey(key); lk != nil {
+		if err := s.loadLazyKey(lk); err != nil {
+			log.Printf("%s: %s\n", lk.name, err)
+			return nil, err
+		}
+	}
+
+	if err := s.confirmKey(key, "An SSH signature was requested."); err != nil {
+		return nil, err
+	}
+
+	if err := s.chargeRateLimit(req); err != nil {
+		return nil, err
+	}
+
+	return s.ExtendedAgent.SignWithFlags(key, data, flags)
+}
+
+// addedKeyPublicKey returns the public key the keyring will list for key, this
+// is the certificate if one was added.
+func addedKeyPublicKey(key agent.AddedKey) (ssh.PublicKey, error) {
+	if key.Certificate != nil {
+		return key.Certificate, nil
+	}
+
+	signer, err := ssh.NewSignerFromKey(key.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return signer.PublicKey(), nil
+}
+
+// underlyingKey returns the key a certificate was issued for, or pk itself.
+func underlyingKey(pk ssh.PublicKey) ssh.PublicKey {
+	if cert, ok := pk.(*ssh.Certificate); ok {
+		return cert.Key
+	}
+
+	return pk
 }
 
 func (s *SSHAgent) getSocketDir() string {
@@ -114,9 +419,181 @@ func (s *SSHAgent) getSocketDir() string {
 	return dir
 }
 
-func (s *SSHAgent) handleYubiSign(contents []byte) ([]byte, error) {
+func (s *SSHAgent) handleYubiSign(peer *peerCred, contents []byte) ([]byte, error) {
+	entry := &auditEntry{Operation: auditYubiSign}
+
+	sig, err := s.yubiSign(peer, contents)
+
+	if s.yubikey != nil {
+		s.mutex.RLock()
+		entry.Slot = s.yubikey.GetSlot()
+		entry.Serial = s.yubikey.Serial()
+		s.mutex.RUnlock()
+	}
+
+	if err := s.auditRecord(entry, peer, contents, err); err != nil {
+		return nil, err
+	}
+
+	return sig, err
+}
+
+func (s *SSHAgent) yubiSign(peer *peerCred, contents []byte) ([]byte, error) {
+	s.mutex.RLock()
+	err := s.yubiWindowOpen()
+	s.mutex.RUnlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	req := s.extensionPolicyRequest(peer, yubiSignExtension, contents)
+
+	if err := s.authorize(req); err != nil {
+		return nil, err
+	}
+
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	// the window may have closed while waiting for a confirmation
+	if err := s.yubiWindowOpen(); err != nil {
+		return nil, err
+	}
+
+	if err := s.chargeRateLimit(req); err != nil {
+		return nil, err
+	}
+
 	return s.yubisigner.Sign(rand.Reader, contents, crypto.SHA256)
 }
+
+// reload rereads the configuration and the key files and derives the GPG
+// identities of all keys again. An invalid configuration is refused and the
+// one in use is kept, like it is refused at startup.
+func (s *SSHAgent) reload() {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	file := s.v.ConfigFileUsed()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		log.Println("reloading config failed:", err)
+		return
+	}
+
+	if err := s.checkConfig(file, data); err != nil {
+		log.Println("reloading config failed, keeping the old config:", err)
+
+		if err := s.v.ReadConfig(bytes.NewReader(s.config)); err != nil {
+			log.Println("restoring the old config failed:", err)
+		}
+
+		return
+	}
+
+	if err := s.v.ReadConfig(bytes.NewReader(data)); err != nil {
+		log.Println("reloading config failed:", err)
+		return
+	}
+
+	s.config = data
+
+	if err := s.loadPolicy(); err != nil {
+		log.Println("reloading policy failed, keeping the old policy:", err)
+	}
+
+	if err := s.loadRateLimits(); err != nil {
+		log.Println("reloading rate limits failed, keeping the old limits:", err)
+	}
+
+	s.loadKeyFiles()
+
+	var infos []*keyInfo
+
+	s.keysMutex.Lock()
+	s.gpgkeys = nil
+	for _, info := range s.keys {
+		infos = append(infos, info)
+	}
+	s.keysMutex.Unlock()
+
+	for _, info := range infos {
+		if err := s.handleGPGImport(info.pk); err != nil {
+			log.Println("deriving GPG key failed:", err)
+		}
+	}
+
+	log.Println("configuration reloaded")
+}
+
+// shutdown wipes all keys from memory and releases the yubikey. The keys in the
+// key store are kept.
+func (s *SSHAgent) shutdown() {
+	s.store = nil
+
+	if s.metricsListener != nil {
+		s.metricsListener.Close()
+	}
+
+	s.keysMutex.Lock()
+	for _, info := range s.keys {
+		wipeKey(info.added.PrivateKey)
+	}
+
+	s.gpgkeys = nil
+	s.keys = make(map[string]*keyInfo)
+	s.lazykeys = nil
+	s.keysMutex.Unlock()
+
+	if err := s.ExtendedAgent.RemoveAll(); err != nil {
+		// a locked keyring refuses to remove the keys, drop it instead.
+		s.ExtendedAgent = agent.NewKeyring().(agent.ExtendedAgent)
+	}
+
+	if s.yubikey != nil {
+		s.mutex.Lock()
+		if s.yubiWindowTimer != nil {
+			s.yubiWindowTimer.Stop()
+		}
+
+		if err := s.yubikey.Close(); err != nil {
+			log.Println(err)
+		}
+
+		s.yubisigner = nil
+		s.mutex.Unlock()
+	}
+}
+
+// wipeKey overwrites the private parts of key.
+func wipeKey(key interface{}) {
+	wipe := func(n *big.Int) {
+		if n == nil {
+			return
+		}
+
+		bits := n.Bits()
+		for i := range bits {
+			bits[i] = 0
+		}
+	}
+
+	switch k := key.(type) {
+	case *ed25519.PrivateKey:
+		for i := range *k {
+			(*k)[i] = 0
+		}
+	case *rsa.PrivateKey:
+		wipe(k.D)
+		wipe(k.Precomputed.Dp)
+		wipe(k.Precomputed.Dq)
+		wipe(k.Precomputed.Qinv)
+		for _, p := range k.Primes {
+			wipe(p)
+		}
+	case *ecdsa.PrivateKey:
+		wipe(k.D)
+	}
+}
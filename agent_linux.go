@@ -1,51 +1,151 @@
 package main
 
 import (
-	"fmt"
+	"errors"
 	"io"
 	"log"
 	"net"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/crypto/ssh/agent"
 )
 
+// daemonSocketEnv is set for the background process started by daemonize, it
+// contains the path of the listening socket that is passed as fd 3.
+const daemonSocketEnv = "SSH_AGENTX_DAEMON_SOCKET"
+
+// drainTimeout is how long we wait for client connections to finish on shutdown.
+const drainTimeout = 5 * time.Second
+
 func (s *SSHAgent) start() {
-	socketDir := s.getSocketDir()
-	socketFile := filepath.Join(socketDir, "agent.sock")
+	var (
+		listeners             []net.Listener
+		socketFile, socketDir string
+	)
 
-	defer func() {
-		os.Remove(socketFile)
-		os.Remove(socketDir)
-	}()
+	if listeners = systemdListeners(); len(listeners) > 0 {
+		s.socket = listeners[0].Addr().String()
+	} else {
+		var l net.Listener
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+		l, socketFile, socketDir = s.listen()
+		listeners = append(listeners, l)
+		s.socket = socketFile
+	}
 
-	go func() {
-		for range c {
+	cleanup := func() {
+		if socketFile != "" {
 			os.Remove(socketFile)
 			os.Remove(socketDir)
-			os.Exit(0)
 		}
+	}
+
+	defer cleanup()
+
+	conns := &connSet{conns: make(map[net.Conn]struct{})}
+
+	if len(s.opts.command) > 0 {
+		go s.serve(listeners[0], conns)
+
+		code := s.runCommand(s.socket)
+
+		cleanup()
+		os.Exit(code)
+	}
+
+	if s.opts.foreground {
+		printEnv(os.Stdout, s.opts.shell, s.socket, os.Getpid())
+	}
+
+	for _, l := range listeners {
+		go s.serve(l, conns)
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	for sig := range c {
+		if sig == syscall.SIGHUP {
+			s.reload()
+			continue
+		}
+
+		log.Println("got", sig, "shutting down")
+
+		for _, l := range listeners {
+			l.Close()
+		}
+
+		conns.drain(drainTimeout)
+		s.shutdown()
+		cleanup()
+
+		os.Exit(0)
+	}
+}
+
+// connSet keeps track of the client connections so they can be drained on
+// shutdown.
+type connSet struct {
+	mutex sync.Mutex
+	wg    sync.WaitGroup
+	conns map[net.Conn]struct{}
+}
+
+func (cs *connSet) add(c net.Conn) {
+	cs.mutex.Lock()
+	cs.conns[c] = struct{}{}
+	cs.wg.Add(1)
+	cs.mutex.Unlock()
+}
+
+func (cs *connSet) remove(c net.Conn) {
+	cs.mutex.Lock()
+	delete(cs.conns, c)
+	cs.wg.Done()
+	cs.mutex.Unlock()
+}
+
+// drain waits for the connections to finish and closes the remaining ones
+// after timeout.
+func (cs *connSet) drain(timeout time.Duration) {
+	done := make(chan struct{})
+
+	go func() {
+		cs.wg.Wait()
+		close(done)
 	}()
 
-	l, err := net.Listen("unix", socketFile)
-	if err != nil {
-		log.Fatalln("Failed to listen on UNIX socket:", err)
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
 	}
 
-	fmt.Println("SSH_AUTH_SOCK=" + socketFile + "; export SSH_AUTH_SOCK;")
-	fmt.Println("SSH_AGENT_PID=" + strconv.Itoa(os.Getpid()) + "; export SSH_AGENT_PID;")
-	fmt.Println("echo Agent pid " + strconv.Itoa(os.Getpid()) + ";")
+	cs.mutex.Lock()
+	for c := range cs.conns {
+		c.Close()
+	}
+	cs.mutex.Unlock()
+
+	<-done
+}
 
+func (s *SSHAgent) serve(l net.Listener, conns *connSet) {
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
 			type temporary interface {
 				Temporary() bool
 			}
@@ -60,10 +160,167 @@ func (s *SSHAgent) start() {
 			log.Fatalln("Failed to accept connections:", err)
 		}
 
+		conns.add(c)
+
 		go func() {
-			if err := agent.ServeAgent(s, c); err != io.EOF {
+			defer conns.remove(c)
+			defer c.Close()
+
+			peer, err := getPeerCred(c)
+			if err != nil {
+				log.Println("Failed to get peer credentials:", err)
+			}
+
+			if err := s.peerAllowed(peer); err != nil {
+				log.Printf("rejecting connection from %s: %s\n", peer, err)
+				return
+			}
+
+			if err := agent.ServeAgent(s.newConnAgent(peer), c); err != io.EOF {
 				log.Println("Agent client connection ended with error:", err)
 			}
 		}()
 	}
 }
+
+// runCommand runs the command given on the command line with the agent
+// environment and returns its exit code.
+func (s *SSHAgent) runCommand(socketFile string) int {
+	cmd := exec.Command(s.opts.command[0], s.opts.command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"SSH_AUTH_SOCK="+socketFile,
+		"SSH_AGENT_PID="+strconv.Itoa(os.Getpid()),
+	)
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	defer signal.Stop(c)
+
+	if err := cmd.Start(); err != nil {
+		log.Println("Failed to run command:", err)
+		return 1
+	}
+
+	go func() {
+		for sig := range c {
+			// the command already gets the interrupt from the terminal
+			if sig == os.Interrupt {
+				continue
+			}
+
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	err := cmd.Wait()
+	if err == nil {
+		return 0
+	}
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+
+		return exitErr.ExitCode()
+	}
+
+	log.Println("Failed to run command:", err)
+
+	return 1
+}
+
+// listen returns the listening socket, inherited from our parent when running
+// in the background, and the socket file and directory to cleanup on exit.
+func (s *SSHAgent) listen() (net.Listener, string, string) {
+	if socketFile := os.Getenv(daemonSocketEnv); socketFile != "" {
+		os.Unsetenv(daemonSocketEnv)
+
+		l, err := net.FileListener(os.NewFile(3, socketFile))
+		if err != nil {
+			log.Fatalln("Failed to use inherited UNIX socket:", err)
+		}
+
+		socketDir := ""
+		if s.opts.bindAddress == "" && !s.singleInstance() {
+			socketDir = filepath.Dir(socketFile)
+		}
+
+		return l, socketFile, socketDir
+	}
+
+	if s.singleInstance() {
+		l, socketFile := s.listenInstance()
+		return l, socketFile, ""
+	}
+
+	socketFile, socketDir := s.opts.bindAddress, ""
+	if socketFile == "" {
+		socketDir = s.getSocketDir()
+		socketFile = filepath.Join(socketDir, "agent.sock")
+	}
+
+	l, err := net.Listen("unix", socketFile)
+	if err != nil {
+		os.Remove(socketDir)
+		log.Fatalln("Failed to listen on UNIX socket:", err)
+	}
+
+	return l, socketFile, socketDir
+}
+
+// daemonize starts the agent in the background like ssh-agent does and prints
+// its environment. The listening socket is created here and passed to the new
+// process. Returns false if we should keep running in the foreground.
+func (s *SSHAgent) daemonize() bool {
+	if s.opts.foreground || len(s.opts.command) > 0 || os.Getenv(daemonSocketEnv) != "" || socketActivated() {
+		return false
+	}
+
+	l, socketFile, socketDir := s.listen()
+
+	ul := l.(*net.UnixListener)
+	ul.SetUnlinkOnClose(false)
+
+	f, err := ul.File()
+	if err != nil {
+		log.Fatalln("Failed to get UNIX socket file:", err)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalln("Failed to find executable:", err)
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonSocketEnv+"="+socketFile)
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if logfile := s.v.GetString("logfile"); logfile != "" {
+		lf, err := os.OpenFile(expandHome(logfile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			log.Fatalln("Failed to open logfile:", err)
+		}
+
+		cmd.Stderr = lf
+	}
+
+	if err := cmd.Start(); err != nil {
+		os.Remove(socketFile)
+		os.Remove(socketDir)
+		log.Fatalln("Failed to start agent:", err)
+	}
+
+	printEnv(os.Stdout, s.opts.shell, socketFile, cmd.Process.Pid)
+
+	return true
+}
+
+func terminateProcess(pid int) error {
+	return syscall.Kill(pid, syscall.SIGTERM)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRunCommand(t *testing.T) {
+	tests := []struct {
+		command []string
+		code    int
+	}{
+		{[]string{"sh", "-c", "exit 0"}, 0},
+		{[]string{"sh", "-c", "exit 3"}, 3},
+		{[]string{"sh", "-c", `test "$SSH_AUTH_SOCK" = /tmp/agent.sock`}, 0},
+		{[]string{"sh", "-c", "kill -TERM $$"}, 128 + 15},
+		{[]string{"/nonexistent/command"}, 1},
+	}
+
+	for _, tt := range tests {
+		s := newTestAgent(t, "")
+		s.opts.command = tt.command
+
+		if code := s.runCommand("/tmp/agent.sock"); code != tt.code {
+			t.Errorf("runCommand(%q) = %d, want %d", tt.command, code, tt.code)
+		}
+	}
+}
+
+func TestConnSetDrain(t *testing.T) {
+	conns := &connSet{conns: make(map[net.Conn]struct{})}
+
+	done, _ := net.Pipe()
+	hanging, other := net.Pipe()
+
+	conns.add(done)
+	conns.add(hanging)
+
+	go conns.remove(done)
+
+	go func() {
+		// the connection that doesn't finish is closed by drain
+		other.Read(make([]byte, 1))
+		conns.remove(hanging)
+	}()
+
+	start := time.Now()
+	conns.drain(100 * time.Millisecond)
+
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("drain() didn't wait for the connections")
+	}
+
+	if _, err := hanging.Write([]byte("x")); err == nil {
+		t.Error("drain() didn't close the remaining connection")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// newTestAgent returns an agent with the TOML config cfg.
+func newTestAgent(t *testing.T, cfg string) *SSHAgent {
+	t.Helper()
+
+	v := viper.New()
+	v.SetConfigType("toml")
+
+	if err := v.ReadConfig(strings.NewReader(cfg)); err != nil {
+		t.Fatal(err)
+	}
+
+	return &SSHAgent{
+		ExtendedAgent: agent.NewKeyring().(agent.ExtendedAgent),
+		opts:          &options{},
+		v:             v,
+		keys:          make(map[string]*keyInfo),
+		ratelimiter:   newRateLimiter(),
+		approvals:     newApprovalQueue(),
+	}
+}
+
+func testEd25519Key(t *testing.T, seed byte) (*ed25519.PrivateKey, ssh.PublicKey) {
+	t.Helper()
+
+	b := make([]byte, ed25519.SeedSize)
+	b[0] = seed
+	key := ed25519.NewKeyFromSeed(b)
+
+	pk, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &key, pk
+}
+
+// testCertificate returns a user certificate for pk signed by a test CA.
+func testCertificate(t *testing.T, pk ssh.PublicKey) *ssh.Certificate {
+	t.Helper()
+
+	ca, _ := testEd25519Key(t, 255)
+
+	signer, err := ssh.NewSignerFromKey(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := &ssh.Certificate{
+		Key:             pk,
+		CertType:        ssh.UserCert,
+		KeyId:           "test",
+		ValidPrincipals: []string{"test"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+// withoutPinentry makes every confirmation fail as if the user denied it.
+func withoutPinentry(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	t.Setenv("GNUPGHOME", t.TempDir())
+}
+
+func TestConfirmKey(t *testing.T) {
+	withoutPinentry(t)
+
+	key, pk := testEd25519Key(t, 1)
+
+	tests := []struct {
+		name  string
+		added agent.AddedKey
+		err   error
+	}{
+		{"no constraint", agent.AddedKey{PrivateKey: key}, nil},
+		{"key", agent.AddedKey{PrivateKey: key, ConfirmBeforeUse: true}, errNotConfirmed},
+		{"certificate", agent.AddedKey{PrivateKey: key, Certificate: testCertificate(t, pk), ConfirmBeforeUse: true}, errNotConfirmed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestAgent(t, "")
+			if err := s.Add(tt.added); err != nil {
+				t.Fatal(err)
+			}
+
+			// GPG keys are derived from the private key
+			if err := s.confirmKey(pk, "test"); !errors.Is(err, tt.err) {
+				t.Errorf("confirmKey() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestGPGSignConfirmCertificate(t *testing.T) {
+	withoutPinentry(t)
+
+	key, pk := testEd25519Key(t, 1)
+
+	s := newTestAgent(t, "[gpg.test]\nname=\"Test\"\nemail=\"test@example.com\"\nmatchcomment=\"test\"\n")
+	if err := s.Add(agent.AddedKey{PrivateKey: key, Certificate: testCertificate(t, pk), Comment: "test", ConfirmBeforeUse: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Extension(gpgSignExtension, testGPGSignRequest("Test <test@example.com>", []byte("data"))); !errors.Is(err, errNotConfirmed) {
+		t.Errorf("Extension() error = %v, want %v", err, errNotConfirmed)
+	}
+}
+
+func TestRemoveLocked(t *testing.T) {
+	withoutPinentry(t)
+
+	key, pk := testEd25519Key(t, 1)
+
+	s := newTestAgent(t, "")
+	if err := s.Add(agent.AddedKey{PrivateKey: key, ConfirmBeforeUse: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Lock([]byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Remove(pk); err == nil {
+		t.Error("Remove() of a locked agent succeeded")
+	}
+
+	if err := s.RemoveAll(); err == nil {
+		t.Error("RemoveAll() of a locked agent succeeded")
+	}
+
+	if err := s.Unlock([]byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the key is still there and still needs a confirmation
+	if _, err := s.Sign(pk, []byte("data")); !errors.Is(err, errNotConfirmed) {
+		t.Errorf("Sign() error = %v, want %v", err, errNotConfirmed)
+	}
+
+	if err := s.Remove(pk); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.keys) != 0 {
+		t.Errorf("Remove() kept the constraints of %d keys", len(s.keys))
+	}
+}
+
+// testGPGSignRequest returns a ssh-gpg-sign@42wim request of uid for data.
+func testGPGSignRequest(uid string, data []byte) []byte {
+	contents := make([]byte, 400)
+	copy(contents, uid)
+
+	return append(contents, data...)
+}
+
+func TestGPGKeyExpires(t *testing.T) {
+	key, pk := testEd25519Key(t, 1)
+
+	s := newTestAgent(t, "[gpg.test]\nname=\"Test\"\nemail=\"test@example.com\"\nmatchcomment=\"test\"\n")
+	if err := s.Add(agent.AddedKey{PrivateKey: key, Comment: "test", LifetimeSecs: 3600}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := testGPGSignRequest("Test <test@example.com>", []byte("data"))
+
+	if _, err := s.Extension(gpgSignExtension, req); err != nil {
+		t.Fatalf("Extension() error = %v", err)
+	}
+
+	expired := time.Now().Add(-time.Second)
+	s.keys[string(pk.Marshal())].expire = &expired
+
+	if _, err := s.Extension(gpgSignExtension, req); err == nil {
+		t.Error("Extension() signed with an expired key")
+	}
+
+	if len(s.gpgkeys) != 0 || len(s.keys) != 0 {
+		t.Errorf("expired key left %d GPG keys and %d keys", len(s.gpgkeys), len(s.keys))
+	}
+}
+
+func TestExtensionLocked(t *testing.T) {
+	key, _ := testEd25519Key(t, 1)
+
+	s := newTestAgent(t, "[gpg.test]\nname=\"Test\"\nemail=\"test@example.com\"\nmatchcomment=\"test\"\n")
+	if err := s.Add(agent.AddedKey{PrivateKey: key, Comment: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := testGPGSignRequest("Test <test@example.com>", []byte("data"))
+
+	if err := s.Lock([]byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ext := range []string{gpgSignExtension, yubiSignExtension, yubiPublicKeyExtension, yubiSetSlotExtension} {
+		if _, err := s.Extension(ext, req); !errors.Is(err, errLocked) {
+			t.Errorf("Extension(%s) error = %v, want %v", ext, err, errLocked)
+		}
+	}
+
+	if err := s.Unlock([]byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Extension(gpgSignExtension, req); err != nil {
+		t.Errorf("Extension() after unlocking error = %v", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"sync"
@@ -27,10 +28,14 @@ func (s *SSHAgent) SSHAgentHandler(conn io.ReadWriteCloser) {
 		return
 	}
 
-	agent.ServeAgent(s, conn)
+	agent.ServeAgent(s.newConnAgent(nil), conn)
 }
 
 func (s *SSHAgent) start() {
+	if len(s.opts.command) > 0 {
+		log.Fatalln("running a command under the agent is not supported on windows")
+	}
+
 	ctx := context.Background()
 	wg := new(sync.WaitGroup)
 	ctx = context.WithValue(ctx, "hv", false)
@@ -78,3 +83,22 @@ func (s *SSHAgent) runApplication(ctx context.Context, myApp app.Application, wg
 		wg.Done()
 	}(myApp)
 }
+
+// daemonize isn't supported on windows, the agent always runs in the foreground.
+func (s *SSHAgent) daemonize() bool {
+	return false
+}
+
+func terminateProcess(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+
+	return p.Kill()
+}
+
+// findInstance isn't supported on windows, the named pipes are fixed already.
+func (s *SSHAgent) findInstance() bool {
+	return false
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// defaultApprovalTimeout is how long a request waits for approval.
+const defaultApprovalTimeout = 5 * time.Minute
+
+var (
+	errApprovalDenied  = errors.New("agent: request denied")
+	errApprovalTimeout = errors.New("agent: request not approved in time")
+)
+
+// pendingRequest is a request waiting in the approval queue.
+type pendingRequest struct {
+	id      int
+	req     policyRequest
+	created time.Time
+	expires time.Time
+	result  chan bool
+}
+
+// pendingInfo is a pending request as returned by the approval extension.
+type pendingInfo struct {
+	ID      int       `json:"id"`
+	Request string    `json:"request"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+type approvalQueue struct {
+	mutex   sync.Mutex
+	nextID  int
+	pending map[int]*pendingRequest
+}
+
+func newApprovalQueue() *approvalQueue {
+	return &approvalQueue{
+		nextID:  1,
+		pending: make(map[int]*pendingRequest),
+	}
+}
+
+// waitApproval queues req until it is approved, denied or times out.
+func (s *SSHAgent) waitApproval(req policyRequest) error {
+	timeout := defaultApprovalTimeout
+	if s.v.IsSet("approval.timeout") {
+		timeout = s.v.GetDuration("approval.timeout")
+	}
+
+	q := s.approvals
+	now := time.Now()
+
+	q.mutex.Lock()
+	p := &pendingRequest{
+		id:      q.nextID,
+		req:     req,
+		created: now,
+		expires: now.Add(timeout),
+		result:  make(chan bool, 1),
+	}
+	q.pending[p.id] = p
+	q.nextID++
+	q.mutex.Unlock()
+
+	defer func() {
+		q.mutex.Lock()
+		delete(q.pending, p.id)
+		q.mutex.Unlock()
+	}()
+
+	msg := fmt.Sprintf("request %d is waiting for approval: %s", p.id, req)
+
+	log.Println(msg)
+	s.runAlertCommand(msg)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case ok := <-p.result:
+		if !ok {
+			log.Printf("request %d denied\n", p.id)
+			return errApprovalDenied
+		}
+
+		log.Printf("request %d approved\n", p.id)
+
+		return nil
+	case <-timer.C:
+		log.Printf("request %d timed out waiting for approval\n", p.id)
+		return errApprovalTimeout
+	}
+}
+
+// handleApproval lists, approves or denies the pending requests. Only
+// ssh-agentx run locally by the same user may do this, otherwise a forwarded
+// agent could approve itself.
+func (s *SSHAgent) handleApproval(peer *peerCred, contents []byte) ([]byte, error) {
+	if !isLocalPeer(peer) {
+		log.Println("refusing approval request from", peer)
+		return nil, errNotPermitted
+	}
+
+	q := s.approvals
+
+	fields := strings.Fields(string(contents))
+
+	if len(fields) == 1 && fields[0] == "list" {
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+
+		list := []pendingInfo{}
+		for _, p := range q.pending {
+			list = append(list, pendingInfo{
+				ID:      p.id,
+				Request: p.req.String(),
+				Created: p.created,
+				Expires: p.expires,
+			})
+		}
+
+		sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+		return json.Marshal(list)
+	}
+
+	if len(fields) != 2 || (fields[0] != "approve" && fields[0] != "deny") {
+		return nil, fmt.Errorf("invalid approval request %q", contents)
+	}
+
+	id, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, err
+	}
+
+	q.mutex.Lock()
+	p, ok := q.pending[id]
+	if ok {
+		delete(q.pending, id)
+	}
+	q.mutex.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("no pending request %d", id)
+	}
+
+	p.result <- fields[0] == "approve"
+
+	return nil, nil
+}
+
+// runPending implements the pending subcommand.
+func runPending(args []string) int {
+	fs := flag.NewFlagSet(agentName+" pending", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s pending\n", agentName)
+	}
+
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	res, err := agentExtension(approvalExtension, []byte("list"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var list []pendingInfo
+	if err := json.Unmarshal(res, &list); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if len(list) == 0 {
+		fmt.Println("no pending requests")
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tWAITING\tEXPIRES IN\tREQUEST")
+
+	for _, p := range list {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", p.ID, time.Since(p.Created).Round(time.Second), time.Until(p.Expires).Round(time.Second), p.Request)
+	}
+
+	w.Flush()
+
+	return 0
+}
+
+// runApprove implements the approve and deny subcommands.
+func runApprove(action string) func([]string) int {
+	return func(args []string) int {
+		fs := flag.NewFlagSet(agentName+" "+action, flag.ExitOnError)
+		fs.Usage = func() {
+			fmt.Fprintf(fs.Output(), "usage: %s %s id ...\n", agentName, action)
+		}
+
+		fs.Parse(args)
+
+		if fs.NArg() == 0 {
+			fs.Usage()
+			return 2
+		}
+
+		code := 0
+
+		for _, id := range fs.Args() {
+			if _, err := agentExtension(approvalExtension, []byte(action+" "+id)); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", id, err)
+				code = 1
+			}
+		}
+
+		return code
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testLocalPeer returns the peer credentials of the test binary itself, which
+// count as ssh-agentx run locally by the same user.
+func testLocalPeer(t *testing.T) *peerCred {
+	t.Helper()
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+
+	return &peerCred{pid: os.Getpid(), uid: os.Getuid(), gid: os.Getgid(), exe: exe}
+}
+
+// waitPending waits until the approval queue of s lists n requests.
+func waitPending(t *testing.T, s *SSHAgent, n int) []pendingInfo {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		out, err := s.handleApproval(testLocalPeer(t), []byte("list"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var list []pendingInfo
+		if err := json.Unmarshal(out, &list); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(list) == n {
+			return list
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("approval queue has %d requests, want %d", len(list), n)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestApproval(t *testing.T) {
+	s := newTestAgent(t, "")
+	local := testLocalPeer(t)
+
+	req := policyRequest{request: gpgSignExtension, uid: "Test <test@example.com>"}
+
+	for _, tt := range []struct {
+		action string
+		err    error
+	}{
+		{"approve", nil},
+		{"deny", errApprovalDenied},
+	} {
+		result := make(chan error, 1)
+
+		go func() {
+			result <- s.waitApproval(req)
+		}()
+
+		list := waitPending(t, s, 1)
+		if list[0].Request != req.String() || !list[0].Expires.After(list[0].Created) {
+			t.Errorf("pending request = %+v", list[0])
+		}
+
+		id := strconv.Itoa(list[0].ID)
+
+		if _, err := s.handleApproval(local, []byte(tt.action+" 100")); err == nil {
+			t.Errorf("%s of an unknown request didn't fail", tt.action)
+		}
+
+		if _, err := s.handleApproval(nil, []byte(tt.action+" "+id)); !errors.Is(err, errNotPermitted) {
+			t.Errorf("%s by an unknown peer error = %v, want %v", tt.action, err, errNotPermitted)
+		}
+
+		if _, err := s.handleApproval(local, []byte(tt.action+" "+id)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := <-result; !errors.Is(err, tt.err) {
+			t.Errorf("waitApproval() after %s error = %v, want %v", tt.action, err, tt.err)
+		}
+
+		waitPending(t, s, 0)
+	}
+
+	for _, contents := range []string{"", "approve", "approve x", "maybe 1", "list all"} {
+		if _, err := s.handleApproval(local, []byte(contents)); err == nil {
+			t.Errorf("handleApproval(%q) didn't fail", contents)
+		}
+	}
+}
+
+func TestApprovalTimeout(t *testing.T) {
+	s := newTestAgent(t, "[approval]\ntimeout=\"50ms\"")
+
+	if err := s.waitApproval(policyRequest{request: policySignRequest}); !errors.Is(err, errApprovalTimeout) {
+		t.Errorf("waitApproval() error = %v, want %v", err, errApprovalTimeout)
+	}
+
+	waitPending(t, s, 0)
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	auditSSHSign  = "ssh-sign"
+	auditGPGSign  = "gpg-sign"
+	auditYubiSign = "yubi-sign"
+)
+
+var errAudit = errors.New("agent: writing audit log failed")
+
+// auditEntry is a line of the audit log. Hash is the SHA-256 of the entry
+// marshalled with an empty Hash and Prev is the Hash of the entry before it,
+// so changing or removing an entry breaks the chain. The chain isn't keyed,
+// anyone who can write the log can also compute new hashes, it only detects
+// accidental damage and careless edits.
+type auditEntry struct {
+	Seq        uint64     `json:"seq"`
+	Time       string     `json:"time"`
+	Operation  string     `json:"op"`
+	Key        string     `json:"key,omitempty"`
+	UID        string     `json:"uid,omitempty"`
+	Slot       string     `json:"slot,omitempty"`
+	Serial     uint32     `json:"serial,omitempty"`
+	DataSHA256 string     `json:"data_sha256"`
+	Peer       *auditPeer `json:"peer,omitempty"`
+	Result     string     `json:"result"`
+	Prev       string     `json:"prev"`
+	Hash       string     `json:"hash"`
+}
+
+type auditPeer struct {
+	Pid     int    `json:"pid"`
+	UID     int    `json:"uid"`
+	GID     int    `json:"gid"`
+	Exe     string `json:"exe,omitempty"`
+	Session string `json:"session,omitempty"`
+}
+
+// auditHead is the last entry of the audit log, it is kept next to the log to
+// detect entries removed from the end. It is written after the entry, so it
+// can be one entry behind when the agent stopped in between.
+type auditHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+type auditLog struct {
+	path  string
+	file  *os.File
+	mutex sync.Mutex
+	seq   uint64
+	prev  string
+}
+
+func (e auditEntry) computeHash() (string, error) {
+	e.Hash = ""
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// openAudit opens the audit log configured in the [audit] section and
+// continues the chain of the entries already in it.
+func (s *SSHAgent) openAudit() error {
+	path := s.v.GetString("audit.path")
+	if path == "" {
+		return nil
+	}
+
+	path = expandHome(path)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	a := &auditLog{path: path}
+
+	err := readAudit(path, func(e *auditEntry) error {
+		a.seq, a.prev = e.Seq, e.Hash
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	a.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	s.audit = a
+
+	return nil
+}
+
+// write appends e to the log and chains it to the previous entry.
+func (a *auditLog) write(e *auditEntry) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	e.Seq = a.seq + 1
+	e.Prev = a.prev
+
+	hash, err := e.computeHash()
+	if err != nil {
+		return err
+	}
+
+	e.Hash = hash
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if _, err := a.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	if err := a.file.Sync(); err != nil {
+		return err
+	}
+
+	a.seq, a.prev = e.Seq, e.Hash
+
+	return writeAuditHead(a.path, auditHead{Seq: e.Seq, Hash: e.Hash})
+}
+
+func writeAuditHead(path string, head auditHead) error {
+	data, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".head.tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path+".head")
+}
+
+func readAuditHead(path string) (auditHead, error) {
+	var head auditHead
+
+	data, err := os.ReadFile(path + ".head")
+	if err != nil {
+		return head, err
+	}
+
+	if err := json.Unmarshal(data, &head); err != nil {
+		return head, fmt.Errorf("%s.head: %w", path, err)
+	}
+
+	return head, nil
+}
+
+// auditRecord writes an entry for a signature over data requested by peer,
+// err is the result of the signing. Returns errAudit when the entry couldn't
+// be written, the signature must not be handed out then.
+func (s *SSHAgent) auditRecord(e *auditEntry, peer *peerCred, data []byte, err error) error {
+	if s.audit == nil {
+		return nil
+	}
+
+	sum := sha256.Sum256(data)
+
+	e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	e.DataSHA256 = hex.EncodeToString(sum[:])
+	e.Result = "ok"
+
+	if err != nil {
+		e.Result = err.Error()
+	}
+
+	if peer != nil {
+		e.Peer = &auditPeer{
+			Pid:     peer.pid,
+			UID:     peer.uid,
+			GID:     peer.gid,
+			Exe:     peer.exe,
+			Session: peer.session,
+		}
+	}
+
+	if err := s.audit.write(e); err != nil {
+		log.Println("writing audit log failed:", err)
+		return errAudit
+	}
+
+	return nil
+}
+
+// readAudit calls fn for every entry of the audit log in path.
+func readAudit(path string, fn func(*auditEntry) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if err == io.EOF && len(data) == 0 {
+			return nil
+		}
+
+		if err == io.EOF {
+			return fmt.Errorf("line %d: incomplete entry", line)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		var e auditEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+
+		if err := fn(&e); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+}
+
+// verifyAudit checks the hash chain of the audit log in path and returns the
+// number of entries.
+func verifyAudit(path string) (uint64, error) {
+	var (
+		seq      uint64
+		prev     string
+		headHash string
+	)
+
+	head, headErr := readAuditHead(path)
+
+	err := readAudit(path, func(e *auditEntry) error {
+		if e.Seq != seq+1 {
+			return fmt.Errorf("expected entry %d, got %d (entries removed)", seq+1, e.Seq)
+		}
+
+		if e.Prev != prev {
+			return fmt.Errorf("entry %d doesn't chain to the previous entry", e.Seq)
+		}
+
+		hash, err := e.computeHash()
+		if err != nil {
+			return err
+		}
+
+		if hash != e.Hash {
+			return fmt.Errorf("entry %d has been modified", e.Seq)
+		}
+
+		seq, prev = e.Seq, e.Hash
+
+		if e.Seq == head.Seq {
+			headHash = e.Hash
+		}
+
+		return nil
+	})
+	if err != nil {
+		return seq, err
+	}
+
+	// the agent may have stopped before the head of the first entry was written
+	if headErr != nil && (!os.IsNotExist(headErr) || seq > 1) {
+		return seq, fmt.Errorf("can't check for removed entries at the end: %w", headErr)
+	}
+
+	switch {
+	case head.Seq == seq && head.Hash == prev:
+	case head.Seq+1 == seq && head.Hash == headHash:
+		// the agent stopped between writing the last entry and the head
+	case head.Seq > seq:
+		return seq, fmt.Errorf("log ends at entry %d but %d entries were written (truncated)", seq, head.Seq)
+	default:
+		return seq, fmt.Errorf("log doesn't match %s.head at entry %d", path, head.Seq)
+	}
+
+	return seq, nil
+}
+
+// runAudit implements the audit subcommand.
+func runAudit(args []string) int {
+	var configFile string
+
+	fs := flag.NewFlagSet(agentName+" audit", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s audit [-f config] verify [file]\n", agentName)
+		fs.PrintDefaults()
+	}
+
+	fs.StringVar(&configFile, "f", "", "path to the ssh-agentx configuration file")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || fs.NArg() > 2 || fs.Arg(0) != "verify" {
+		fs.Usage()
+		return 2
+	}
+
+	path := fs.Arg(1)
+
+	if path == "" {
+		s := &SSHAgent{opts: &options{configFile: configFile}}
+
+		v, err := s.parseConfig()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "reading config:", err)
+			return 1
+		}
+
+		if path = v.GetString("audit.path"); path == "" {
+			fmt.Fprintln(os.Stderr, "no audit log configured")
+			return 1
+		}
+
+		path = expandHome(path)
+	}
+
+	n, err := verifyAudit(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: verification failed after %d entries: %s\n", path, n, err)
+		return 1
+	}
+
+	fmt.Printf("%s: %d entries OK\n", path, n)
+
+	return 0
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestAudit writes n entries to a new audit log and returns its path.
+func writeTestAudit(t *testing.T, n int) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	s := newTestAgent(t, "[audit]\npath=\""+filepath.ToSlash(path)+"\"\n")
+	if err := s.openAudit(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.audit.file.Close()
+
+	for i := 0; i < n; i++ {
+		e := &auditEntry{Operation: auditSSHSign, Key: "SHA256:test"}
+		if err := s.auditRecord(e, &peerCred{pid: 1, uid: 1000, exe: "/usr/bin/ssh"}, []byte{byte(i)}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return path
+}
+
+func readTestAuditLines(t *testing.T, path string) [][]byte {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+}
+
+func writeTestAuditLines(t *testing.T, path string, lines [][]byte) {
+	t.Helper()
+
+	data := append(bytes.Join(lines, []byte("\n")), '\n')
+
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyAudit(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, path string)
+		n      uint64
+		err    string
+	}{
+		{
+			name:   "intact",
+			change: func(t *testing.T, path string) {},
+			n:      3,
+		},
+		{
+			name: "modified entry",
+			change: func(t *testing.T, path string) {
+				lines := readTestAuditLines(t, path)
+				lines[1] = bytes.Replace(lines[1], []byte(`"uid":1000`), []byte(`"uid":1001`), 1)
+				writeTestAuditLines(t, path, lines)
+			},
+			n:   1,
+			err: "entry 2 has been modified",
+		},
+		{
+			name: "removed entry",
+			change: func(t *testing.T, path string) {
+				lines := readTestAuditLines(t, path)
+				writeTestAuditLines(t, path, append(lines[:1:1], lines[2:]...))
+			},
+			n:   1,
+			err: "entries removed",
+		},
+		{
+			name: "swapped entries",
+			change: func(t *testing.T, path string) {
+				lines := readTestAuditLines(t, path)
+				lines[1], lines[2] = lines[2], lines[1]
+				writeTestAuditLines(t, path, lines)
+			},
+			n:   1,
+			err: "entries removed",
+		},
+		{
+			name: "truncated",
+			change: func(t *testing.T, path string) {
+				writeTestAuditLines(t, path, readTestAuditLines(t, path)[:2])
+			},
+			n:   2,
+			err: "truncated",
+		},
+		{
+			name: "incomplete entry",
+			change: func(t *testing.T, path string) {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if err := os.WriteFile(path, data[:len(data)-10], 0o600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			n:   2,
+			err: "incomplete entry",
+		},
+		{
+			name: "head one entry behind",
+			change: func(t *testing.T, path string) {
+				setTestAuditHead(t, path, readTestAuditLines(t, path)[1])
+			},
+			n: 3,
+		},
+		{
+			name: "head two entries behind",
+			change: func(t *testing.T, path string) {
+				setTestAuditHead(t, path, readTestAuditLines(t, path)[0])
+			},
+			n:   3,
+			err: "doesn't match",
+		},
+		{
+			name: "head of another log",
+			change: func(t *testing.T, path string) {
+				other := writeTestAudit(t, 3)
+
+				data, err := os.ReadFile(other + ".head")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if err := os.WriteFile(path+".head", data, 0o600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			n:   3,
+			err: "doesn't match",
+		},
+		{
+			name: "missing head",
+			change: func(t *testing.T, path string) {
+				if err := os.Remove(path + ".head"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			n:   3,
+			err: "can't check",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestAudit(t, 3)
+			tt.change(t, path)
+
+			n, err := verifyAudit(path)
+			if n != tt.n {
+				t.Errorf("verifyAudit() = %d entries, want %d", n, tt.n)
+			}
+
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("verifyAudit() error = %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("verifyAudit() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// setTestAuditHead points the head of the log in path to the entry line.
+func setTestAuditHead(t *testing.T, path string, line []byte) {
+	t.Helper()
+
+	dir := filepath.Dir(path)
+	entry := filepath.Join(dir, "entry.jsonl")
+
+	writeTestAuditLines(t, entry, [][]byte{line})
+
+	var e *auditEntry
+
+	if err := readAudit(entry, func(a *auditEntry) error {
+		e = a
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeAuditHead(path, auditHead{Seq: e.Seq, Hash: e.Hash}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyAuditFirstEntry(t *testing.T) {
+	// the agent stopped before the head of the first entry was written
+	path := writeTestAudit(t, 1)
+	if err := os.Remove(path + ".head"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := verifyAudit(path); n != 1 || err != nil {
+		t.Errorf("verifyAudit() = %d, %v, want 1 entry", n, err)
+	}
+}
+
+func TestOpenAuditContinues(t *testing.T) {
+	path := writeTestAudit(t, 2)
+
+	s := newTestAgent(t, "[audit]\npath=\""+filepath.ToSlash(path)+"\"\n")
+	if err := s.openAudit(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.audit.file.Close()
+
+	if err := s.auditRecord(&auditEntry{Operation: auditGPGSign, UID: "A <a@x>"}, nil, []byte("data"), errNotConfirmed); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := verifyAudit(path); n != 3 || err != nil {
+		t.Errorf("verifyAudit() = %d, %v, want 3 entries", n, err)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// subcommands are the commands that don't start an agent, a command with the
+// same name can still be run under the agent after --.
+var subcommands = map[string]func([]string) int{
+	"audit":   runAudit,
+	"yubikey": runYubikey,
+	"pending": runPending,
+	"approve": runApprove("approve"),
+	"deny":    runApprove("deny"),
+}
+
+// options are the ssh-agent compatible command line flags.
+type options struct {
+	bindAddress string
+	shell       string
+	foreground  bool
+	debug       bool
+	kill        bool
+	lifetime    time.Duration
+	configFile  string
+	command     []string
+}
+
+func parseFlags() (*options, error) {
+	var (
+		opts     options
+		csh, sh  bool
+		lifetime string
+	)
+
+	fs := flag.NewFlagSet(agentName, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s [-c | -s] [-Dd] [-a bind_address] [-f config] [-t life] [command [arg ...]]\n", agentName)
+		fmt.Fprintf(fs.Output(), "       %s [-c | -s] -k\n", agentName)
+		fs.PrintDefaults()
+	}
+
+	fs.StringVar(&opts.bindAddress, "a", "", "bind the agent to the UNIX-domain socket bind_address")
+	fs.BoolVar(&csh, "c", false, "generate C-shell commands on stdout")
+	fs.BoolVar(&sh, "s", false, "generate Bourne shell commands on stdout")
+	fs.BoolVar(&opts.foreground, "D", false, "foreground mode")
+	fs.BoolVar(&opts.debug, "d", false, "debug mode, stays in the foreground and logs all operations")
+	fs.BoolVar(&opts.kill, "k", false, "kill the agent given by the SSH_AGENT_PID environment variable")
+	fs.StringVar(&lifetime, "t", "", "default maximum lifetime of identities added to the agent")
+	fs.StringVar(&opts.configFile, "f", "", "path to the ssh-agentx configuration file")
+
+	fs.Parse(os.Args[1:])
+
+	opts.command = fs.Args()
+
+	if csh && sh {
+		return nil, fmt.Errorf("-c and -s are mutually exclusive")
+	}
+
+	switch {
+	case csh:
+		opts.shell = "csh"
+	case sh:
+		opts.shell = "sh"
+	default:
+		opts.shell = shellFromEnv()
+	}
+
+	if opts.debug {
+		opts.foreground = true
+	}
+
+	if lifetime != "" {
+		d, err := parseLifetime(lifetime)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lifetime %s: %w", lifetime, err)
+		}
+
+		opts.lifetime = d
+	}
+
+	return &opts, nil
+}
+
+// shellFromEnv guesses the output syntax from $SHELL, like ssh-agent does.
+func shellFromEnv() string {
+	shell := os.Getenv("SHELL")
+
+	switch {
+	case strings.HasSuffix(shell, "csh"):
+		return "csh"
+	case strings.HasSuffix(shell, "fish"):
+		return "fish"
+	default:
+		return "sh"
+	}
+}
+
+// parseLifetime parses a lifetime in the OpenSSH time format (eg 90, 1h30m, 1w).
+// A number without unit is a number of seconds.
+func parseLifetime(s string) (time.Duration, error) {
+	units := map[byte]time.Duration{
+		's': time.Second,
+		'm': time.Minute,
+		'h': time.Hour,
+		'd': 24 * time.Hour,
+		'w': 7 * 24 * time.Hour,
+	}
+
+	var total time.Duration
+
+	s = strings.ToLower(s)
+
+	for s != "" {
+		i := 0
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+
+		if i == 0 {
+			return 0, fmt.Errorf("expected number at %q", s)
+		}
+
+		n, err := strconv.Atoi(s[:i])
+		if err != nil {
+			return 0, err
+		}
+
+		unit := time.Second
+
+		if i < len(s) {
+			u, ok := units[s[i]]
+			if !ok {
+				return 0, fmt.Errorf("unknown unit %q", s[i:i+1])
+			}
+
+			unit = u
+			i++
+		}
+
+		total += time.Duration(n) * unit
+		s = s[i:]
+	}
+
+	if total <= 0 {
+		return 0, fmt.Errorf("lifetime must be positive")
+	}
+
+	return total, nil
+}
+
+// printEnv prints the commands to set the agent environment in the syntax of shell.
+func printEnv(w io.Writer, shell, socketFile string, pid int) {
+	switch shell {
+	case "csh":
+		fmt.Fprintf(w, "setenv SSH_AUTH_SOCK %s;\n", socketFile)
+		fmt.Fprintf(w, "setenv SSH_AGENT_PID %d;\n", pid)
+	case "fish":
+		fmt.Fprintf(w, "set -x SSH_AUTH_SOCK %s;\n", socketFile)
+		fmt.Fprintf(w, "set -x SSH_AGENT_PID %d;\n", pid)
+	default:
+		fmt.Fprintf(w, "SSH_AUTH_SOCK=%s; export SSH_AUTH_SOCK;\n", socketFile)
+		fmt.Fprintf(w, "SSH_AGENT_PID=%d; export SSH_AGENT_PID;\n", pid)
+	}
+
+	fmt.Fprintf(w, "echo Agent pid %d;\n", pid)
+}
+
+// printKillEnv prints the commands to unset the agent environment in the syntax of shell.
+func printKillEnv(w io.Writer, shell string, pid int) {
+	switch shell {
+	case "csh":
+		fmt.Fprintln(w, "unsetenv SSH_AUTH_SOCK;")
+		fmt.Fprintln(w, "unsetenv SSH_AGENT_PID;")
+	case "fish":
+		fmt.Fprintln(w, "set -e SSH_AUTH_SOCK;")
+		fmt.Fprintln(w, "set -e SSH_AGENT_PID;")
+	default:
+		fmt.Fprintln(w, "unset SSH_AUTH_SOCK;")
+		fmt.Fprintln(w, "unset SSH_AGENT_PID;")
+	}
+
+	fmt.Fprintf(w, "echo Agent pid %d killed;\n", pid)
+}
+
+// killAgent kills the agent given by SSH_AGENT_PID.
+func (s *SSHAgent) killAgent() error {
+	pidStr := os.Getenv("SSH_AGENT_PID")
+	if pidStr == "" {
+		return fmt.Errorf("SSH_AGENT_PID not set, cannot kill agent")
+	}
+
+	pid, err := strconv.Atoi(pidStr)
+	if err != nil || pid < 1 {
+		return fmt.Errorf("SSH_AGENT_PID=\"%s\", which is not a good PID", pidStr)
+	}
+
+	if err := terminateProcess(pid); err != nil {
+		return fmt.Errorf("kill %d: %w", pid, err)
+	}
+
+	printKillEnv(os.Stdout, s.opts.shell, pid)
+
+	return nil
+}
+
+// agentExtension sends an extension request to the agent in SSH_AUTH_SOCK.
+func agentExtension(extensionType string, contents []byte) ([]byte, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, fmt.Errorf("SSH_AUTH_SOCK not set")
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	res, err := agent.NewClient(conn).Extension(extensionType, contents)
+	if err != nil {
+		return nil, fmt.Errorf("agent refused: %w", err)
+	}
+
+	return res, nil
+}
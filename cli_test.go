@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestParseLifetime(t *testing.T) {
+	tests := []struct {
+		s    string
+		want time.Duration
+		ok   bool
+	}{
+		{"90", 90 * time.Second, true},
+		{"90s", 90 * time.Second, true},
+		{"1h30m", 90 * time.Minute, true},
+		{"1H30M", 90 * time.Minute, true},
+		{"1d", 24 * time.Hour, true},
+		{"1w2d", 9 * 24 * time.Hour, true},
+		{"10m30", 10*time.Minute + 30*time.Second, true},
+		{"", 0, false},
+		{"0", 0, false},
+		{"h", 0, false},
+		{"1y", 0, false},
+		{"-1", 0, false},
+		{"1.5h", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, err := parseLifetime(tt.s)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseLifetime(%q) = %s, %v, want %s ok %v", tt.s, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestPrintEnv(t *testing.T) {
+	tests := []struct {
+		shell string
+		env   string
+		kill  string
+	}{
+		{
+			shell: "sh",
+			env:   "SSH_AUTH_SOCK=/tmp/agent.sock; export SSH_AUTH_SOCK;\nSSH_AGENT_PID=42; export SSH_AGENT_PID;\necho Agent pid 42;\n",
+			kill:  "unset SSH_AUTH_SOCK;\nunset SSH_AGENT_PID;\necho Agent pid 42 killed;\n",
+		},
+		{
+			shell: "csh",
+			env:   "setenv SSH_AUTH_SOCK /tmp/agent.sock;\nsetenv SSH_AGENT_PID 42;\necho Agent pid 42;\n",
+			kill:  "unsetenv SSH_AUTH_SOCK;\nunsetenv SSH_AGENT_PID;\necho Agent pid 42 killed;\n",
+		},
+		{
+			shell: "fish",
+			env:   "set -x SSH_AUTH_SOCK /tmp/agent.sock;\nset -x SSH_AGENT_PID 42;\necho Agent pid 42;\n",
+			kill:  "set -e SSH_AUTH_SOCK;\nset -e SSH_AGENT_PID;\necho Agent pid 42 killed;\n",
+		},
+	}
+
+	for _, tt := range tests {
+		var env, kill bytes.Buffer
+
+		printEnv(&env, tt.shell, "/tmp/agent.sock", 42)
+		printKillEnv(&kill, tt.shell, 42)
+
+		if env.String() != tt.env {
+			t.Errorf("printEnv(%s) = %q, want %q", tt.shell, env.String(), tt.env)
+		}
+
+		if kill.String() != tt.kill {
+			t.Errorf("printKillEnv(%s) = %q, want %q", tt.shell, kill.String(), tt.kill)
+		}
+	}
+}
+
+func TestShellFromEnv(t *testing.T) {
+	for shell, want := range map[string]string{
+		"/bin/bash":          "sh",
+		"/usr/bin/tcsh":      "csh",
+		"/usr/bin/fish":      "fish",
+		"":                   "sh",
+		"/usr/local/bin/zsh": "sh",
+	} {
+		t.Setenv("SHELL", shell)
+
+		if got := shellFromEnv(); got != want {
+			t.Errorf("shellFromEnv() with SHELL=%s = %s, want %s", shell, got, want)
+		}
+	}
+}
+
+func TestDefaultLifetime(t *testing.T) {
+	key, pk := testEd25519Key(t, 1)
+
+	s := newTestAgent(t, "")
+	s.opts.lifetime = time.Hour
+
+	if err := s.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+
+	expire := s.keys[string(pk.Marshal())].expire
+	if expire == nil || time.Until(*expire) > time.Hour || time.Until(*expire) < 59*time.Minute {
+		t.Errorf("key expires at %v, want in an hour", expire)
+	}
+}
+
+func TestParseFlagsCommand(t *testing.T) {
+	args := os.Args
+	defer func() { os.Args = args }()
+
+	os.Args = []string{agentName, "-s", "-t", "1h", "make", "-j", "4"}
+
+	opts, err := parseFlags()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(opts.command, " ") != "make -j 4" || opts.shell != "sh" || opts.lifetime != time.Hour {
+		t.Errorf("parseFlags() = %+v", opts)
+	}
+}
@@ -1,23 +1,31 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 )
 
 func (s *SSHAgent) parseConfig() (*viper.Viper, error) {
 	v := viper.New()
 
-	cfgPath, err := os.UserConfigDir()
-	if err != nil {
-		return v, err
-	}
+	if s.opts.configFile != "" {
+		v.SetConfigFile(expandHome(s.opts.configFile))
+	} else {
+		cfgPath, err := os.UserConfigDir()
+		if err != nil {
+			return v, err
+		}
 
-	v.AddConfigPath(".")
-	v.AddConfigPath(filepath.Join(cfgPath, agentName))
-	v.SetConfigName(agentName)
+		v.AddConfigPath(".")
+		v.AddConfigPath(filepath.Join(cfgPath, agentName))
+		v.SetConfigName(agentName)
+	}
 
 	if err := v.ReadInConfig(); err != nil {
 		return v, err
@@ -30,8 +38,65 @@ func (s *SSHAgent) parseConfig() (*viper.Viper, error) {
 		}
 	*/
 
-	// reload config on file changes
+	s.config, _ = os.ReadFile(v.ConfigFileUsed())
+
+	// reload config on file changes, the watcher already read the new file
+	// but reload puts the old one back when it is invalid
+	v.OnConfigChange(func(fsnotify.Event) { s.reload() })
 	v.WatchConfig()
 
 	return v, nil
 }
+
+// checkConfig checks the config file contents data before they replace the
+// config in use.
+func (s *SSHAgent) checkConfig(file string, data []byte) error {
+	v := viper.New()
+	v.SetConfigFile(file)
+
+	if err := v.ReadConfig(bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	c := &SSHAgent{v: v, keys: make(map[string]*keyInfo), ratelimiter: newRateLimiter()}
+
+	s.keysMutex.RLock()
+	for k, info := range s.keys {
+		c.keys[k] = info
+	}
+
+	c.lazykeys = s.lazykeys
+	s.keysMutex.RUnlock()
+
+	if err := c.loadPolicy(); err != nil {
+		return fmt.Errorf("invalid policy: %w", err)
+	}
+
+	if err := c.loadRateLimits(); err != nil {
+		return fmt.Errorf("invalid rate limits: %w", err)
+	}
+
+	if err := c.checkGPGSections(); err != nil {
+		return fmt.Errorf("invalid gpg configuration: %w", err)
+	}
+
+	if err := c.checkGPGFingerprints(); err != nil {
+		return fmt.Errorf("gpg: %w", err)
+	}
+
+	return nil
+}
+
+// expandHome replaces a leading ~ in path with the home directory of the user.
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+
+	return filepath.Join(home, path[1:])
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gitObject is a git commit or tag object as it is passed to gpg for signing.
+type gitObject struct {
+	kind      string // commit or tag
+	tree      string
+	parents   []string
+	author    string
+	committer string
+	object    string
+	objType   string
+	tag       string
+	tagger    string
+	subject   string
+}
+
+// gitHeaders are the headers of a commit and a tag in the order git writes
+// them, other headers like gpgsig or encoding come after these.
+var gitHeaders = map[string][]string{
+	"commit": {"tree", "parent", "author", "committer"},
+	"tag":    {"object", "type", "tag", "tagger"},
+}
+
+// parseGitObject parses data as a git commit or tag object, it returns false
+// when data doesn't look like one.
+func parseGitObject(data []byte) (*gitObject, bool) {
+	header, body := data, []byte(nil)
+
+	if i := bytes.Index(data, []byte("\n\n")); i >= 0 {
+		header, body = data[:i], data[i+2:]
+	}
+
+	var (
+		obj   gitObject
+		order []string
+		last  int
+	)
+
+	for i, line := range strings.Split(string(header), "\n") {
+		// continuation of a multi-line header like mergetag
+		if i > 0 && strings.HasPrefix(line, " ") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, false
+		}
+
+		if i == 0 {
+			switch key {
+			case "tree":
+				obj.kind = "commit"
+			case "object":
+				obj.kind = "tag"
+			default:
+				return nil, false
+			}
+
+			order, last = gitHeaders[obj.kind], -1
+		}
+
+		// the known headers must be in the order git writes them, only parent
+		// may be repeated or left out, so there is one author, committer or
+		// tagger
+		if j := indexString(order, key); j >= 0 {
+			switch {
+			case j == last+1:
+			case j == last && key == "parent":
+			case j == last+2 && order[last+1] == "parent":
+			default:
+				return nil, false
+			}
+
+			last = j
+		} else if last != len(order)-1 {
+			return nil, false
+		}
+
+		switch key {
+		case "tree":
+			obj.tree = value
+		case "parent":
+			obj.parents = append(obj.parents, value)
+		case "author":
+			obj.author = value
+		case "committer":
+			obj.committer = value
+		case "object":
+			obj.object = value
+		case "type":
+			obj.objType = value
+		case "tag":
+			obj.tag = value
+		case "tagger":
+			obj.tagger = value
+		}
+	}
+
+	switch obj.kind {
+	case "commit":
+		if !isObjectID(obj.tree) || obj.author == "" || obj.committer == "" {
+			return nil, false
+		}
+
+		for _, p := range obj.parents {
+			if !isObjectID(p) {
+				return nil, false
+			}
+		}
+	case "tag":
+		if !isObjectID(obj.object) || obj.objType == "" || obj.tag == "" {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+
+	obj.subject, _, _ = strings.Cut(strings.TrimLeft(string(body), "\n"), "\n")
+
+	return &obj, true
+}
+
+func indexString(list []string, s string) int {
+	for i, e := range list {
+		if e == s {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// isObjectID returns true for a SHA-1 or SHA-256 git object id.
+func isObjectID(id string) bool {
+	if len(id) != 40 && len(id) != 64 {
+		return false
+	}
+
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// gitIdent splits a git identity line (Name <email> 1700000000 +0100) in the
+// "Name <email>" part and its time.
+func gitIdent(ident string) (string, time.Time) {
+	fields := strings.Fields(ident)
+	if len(fields) < 3 {
+		return ident, time.Time{}
+	}
+
+	ts, err := strconv.ParseInt(fields[len(fields)-2], 10, 64)
+	if err != nil {
+		return ident, time.Time{}
+	}
+
+	t := time.Unix(ts, 0)
+
+	if tz, err := time.Parse("-0700", fields[len(fields)-1]); err == nil {
+		t = t.In(tz.Location())
+	}
+
+	return strings.Join(fields[:len(fields)-2], " "), t
+}
+
+// splitGitIdent splits "Name <email>" in the name and the email.
+func splitGitIdent(ident string) (string, string, bool) {
+	name, rest, ok := strings.Cut(ident, "<")
+	if !ok || !strings.HasSuffix(rest, ">") {
+		return "", "", false
+	}
+
+	return strings.TrimSpace(name), strings.TrimSuffix(rest, ">"), true
+}
+
+func formatGitIdent(ident string) string {
+	name, t := gitIdent(ident)
+	if t.IsZero() {
+		return name
+	}
+
+	return name + " " + t.Format("2006-01-02 15:04 -0700")
+}
+
+// gpgPreview describes the data of a GPG signing request for a confirmation.
+func gpgPreview(data []byte) string {
+	obj, ok := parseGitObject(data)
+	if !ok {
+		return fmt.Sprintf("%d bytes of data with SHA256 %x.", len(data), sha256.Sum256(data))
+	}
+
+	var b strings.Builder
+
+	switch obj.kind {
+	case "commit":
+		fmt.Fprintf(&b, "Commit: %s\n", obj.subject)
+		fmt.Fprintf(&b, "Tree: %s\n", obj.tree)
+
+		for _, p := range obj.parents {
+			fmt.Fprintf(&b, "Parent: %s\n", p)
+		}
+
+		fmt.Fprintf(&b, "Author: %s\n", formatGitIdent(obj.author))
+		fmt.Fprintf(&b, "Committer: %s", formatGitIdent(obj.committer))
+	case "tag":
+		fmt.Fprintf(&b, "Tag %s: %s\n", obj.tag, obj.subject)
+		fmt.Fprintf(&b, "Object: %s %s\n", obj.objType, obj.object)
+		fmt.Fprintf(&b, "Tagger: %s", formatGitIdent(obj.tagger))
+	}
+
+	return b.String()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const (
+	testTree   = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+	testParent = "73e3d4e2a897c921f207f5a1ae65c7b6175b1afe"
+	testAlice  = "alice <alice@example.com> 1700000000 +0100"
+	testMallet = "mallet <mallet@example.com> 1700000000 +0100"
+)
+
+func testObject(lines ...string) []byte {
+	return []byte(strings.Join(lines, "\n") + "\n\nsubject\n\nbody\n")
+}
+
+func TestParseGitObject(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []byte
+		ok        bool
+		kind      string
+		committer string
+		tagger    string
+	}{
+		{
+			name:      "commit",
+			data:      testObject("tree "+testTree, "parent "+testParent, "author "+testAlice, "committer "+testAlice),
+			ok:        true,
+			kind:      "commit",
+			committer: testAlice,
+		},
+		{
+			name:      "root commit",
+			data:      testObject("tree "+testTree, "author "+testAlice, "committer "+testAlice),
+			ok:        true,
+			kind:      "commit",
+			committer: testAlice,
+		},
+		{
+			name:      "merge commit with mergetag and encoding",
+			data:      testObject("tree "+testTree, "parent "+testParent, "parent "+testParent, "author "+testAlice, "committer "+testAlice, "encoding ISO-8859-1", "mergetag object "+testParent, " type commit", " tag v1"),
+			ok:        true,
+			kind:      "commit",
+			committer: testAlice,
+		},
+		{
+			name: "duplicate committer",
+			data: testObject("tree "+testTree, "author "+testAlice, "committer "+testMallet, "committer "+testAlice),
+		},
+		{
+			name: "duplicate author",
+			data: testObject("tree "+testTree, "author "+testAlice, "author "+testMallet, "committer "+testAlice),
+		},
+		{
+			name: "duplicate tree",
+			data: testObject("tree "+testTree, "tree "+testTree, "author "+testAlice, "committer "+testAlice),
+		},
+		{
+			name: "committer before author",
+			data: testObject("tree "+testTree, "committer "+testAlice, "author "+testAlice),
+		},
+		{
+			name: "parent after author",
+			data: testObject("tree "+testTree, "author "+testAlice, "parent "+testParent, "committer "+testAlice),
+		},
+		{
+			name: "extra header before committer",
+			data: testObject("tree "+testTree, "author "+testAlice, "encoding UTF-8", "committer "+testAlice),
+		},
+		{
+			name: "committer after extra header",
+			data: testObject("tree "+testTree, "author "+testAlice, "committer "+testMallet, "encoding UTF-8", "committer "+testAlice),
+		},
+		{
+			name: "no committer",
+			data: testObject("tree "+testTree, "author "+testAlice),
+		},
+		{
+			name: "invalid tree",
+			data: testObject("tree xyz", "author "+testAlice, "committer "+testAlice),
+		},
+		{
+			name:   "tag",
+			data:   testObject("object "+testParent, "type commit", "tag v1", "tagger "+testAlice),
+			ok:     true,
+			kind:   "tag",
+			tagger: testAlice,
+		},
+		{
+			name: "duplicate tagger",
+			data: testObject("object "+testParent, "type commit", "tag v1", "tagger "+testMallet, "tagger "+testAlice),
+		},
+		{
+			name: "tagger before tag",
+			data: testObject("object "+testParent, "type commit", "tagger "+testAlice, "tag v1"),
+		},
+		{
+			name: "not a git object",
+			data: []byte("hello world\n"),
+		},
+		{
+			name: "continuation first",
+			data: testObject(" tree "+testTree, "author "+testAlice, "committer "+testAlice),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj, ok := parseGitObject(tt.data)
+			if ok != tt.ok {
+				t.Fatalf("parseGitObject() ok = %v, want %v", ok, tt.ok)
+			}
+
+			if !ok {
+				return
+			}
+
+			if obj.kind != tt.kind || obj.committer != tt.committer || obj.tagger != tt.tagger {
+				t.Errorf("parseGitObject() = %s committer %q tagger %q, want %s committer %q tagger %q", obj.kind, obj.committer, obj.tagger, tt.kind, tt.committer, tt.tagger)
+			}
+
+			if obj.subject != "subject" {
+				t.Errorf("subject = %q, want %q", obj.subject, "subject")
+			}
+		})
+	}
+}
+
+func TestGPGPreview(t *testing.T) {
+	opaque := []byte("hello world\n")
+	invalid := testObject("tree xyz", "author "+testAlice, "committer "+testAlice)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		preview string
+	}{
+		{
+			name: "commit",
+			data: testObject("tree "+testTree, "parent "+testParent, "author "+testAlice, "committer "+testAlice),
+			preview: "Commit: subject\n" +
+				"Tree: " + testTree + "\n" +
+				"Parent: " + testParent + "\n" +
+				"Author: alice <alice@example.com> 2023-11-14 23:13 +0100\n" +
+				"Committer: alice <alice@example.com> 2023-11-14 23:13 +0100",
+		},
+		{
+			name: "tag",
+			data: testObject("object "+testParent, "type commit", "tag v1", "tagger "+testAlice),
+			preview: "Tag v1: subject\n" +
+				"Object: commit " + testParent + "\n" +
+				"Tagger: alice <alice@example.com> 2023-11-14 23:13 +0100",
+		},
+		{
+			name:    "opaque data",
+			data:    opaque,
+			preview: fmt.Sprintf("12 bytes of data with SHA256 %x.", sha256.Sum256(opaque)),
+		},
+		{
+			name:    "commit with an invalid tree",
+			data:    invalid,
+			preview: fmt.Sprintf("%d bytes of data with SHA256 %x.", len(invalid), sha256.Sum256(invalid)),
+		},
+	}
+
+	for _, tt := range tests {
+		if got := gpgPreview(tt.data); got != tt.preview {
+			t.Errorf("%s: gpgPreview() = %q, want %q", tt.name, got, tt.preview)
+		}
+	}
+}
@@ -5,6 +5,7 @@ go 1.21
 require (
 	github.com/ProtonMail/go-crypto v0.0.0-20210408094314-bf0c5240ed99
 	github.com/buptczq/WinCryptSSHAgent v1.1.8
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/go-piv/piv-go v1.11.0
 	github.com/pkg/errors v0.9.1
 	github.com/spf13/viper v1.7.1
@@ -16,7 +17,6 @@ require (
 	github.com/Microsoft/go-winio v0.4.16 // indirect
 	github.com/bi-zone/go-ole v1.2.5 // indirect
 	github.com/bi-zone/wmi v1.1.4 // indirect
-	github.com/fsnotify/fsnotify v1.4.7 // indirect
 	github.com/go-ole/go-ole v1.2.4 // indirect
 	github.com/hashicorp/errwrap v1.0.0 // indirect
 	github.com/hashicorp/go-multierror v1.0.0 // indirect
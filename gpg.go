@@ -3,14 +3,15 @@ package main
 import (
 	"bytes"
 	"crypto"
+	"crypto/ecdsa"
 	"crypto/ed25519"
+	"crypto/elliptic"
 	gorsa "crypto/rsa"
 	"errors"
 	"fmt"
 	"log"
 	"os"
 	"strings"
-	"time"
 
 	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/ProtonMail/go-crypto/openpgp/armor"
@@ -20,109 +21,195 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+var (
+	errNoSigner         = errors.New("no signer found")
+	errNotGitObject     = errors.New("not a git commit or tag")
+	errIdentityMismatch = errors.New("git identity doesn't match the signing identity")
+)
+
 type GPGKey struct {
-	signer *openpgp.Entity
-	pk     ssh.PublicKey
+	signer   *openpgp.Entity
+	pk       ssh.PublicKey
+	uids     []string          // the first one is the primary uid
+	sections map[string]string // uid -> [gpg.*] section
 }
 
-func (s *SSHAgent) handleGPGSign(contents []byte) ([]byte, error) {
-	var (
-		signer *openpgp.Entity
-		buf    bytes.Buffer
-	)
+func (s *SSHAgent) handleGPGSign(c *connAgent, contents []byte) ([]byte, error) {
+	peer := c.requestPeer()
 
-	uidlen := bytes.IndexByte(contents[:400], 0)
-	uid := string(contents[:uidlen])
-	data := contents[400:]
-
-	for _, k := range s.gpgkeys {
-		if _, ok := k.signer.Identities[uid]; ok {
-			signer = k.signer
-		}
+	req, err := parseGPGSignRequest(contents)
+	if err != nil {
+		log.Printf("invalid %s request from %s: %s\n", gpgSignExtension, peer, err)
+		return nil, err
 	}
 
-	if signer == nil {
-		log.Printf("no GPG signer found for %s\n", uid)
-		return nil, fmt.Errorf("no signer found")
+	data := req.data
+
+	entry := &auditEntry{Operation: auditGPGSign, UID: req.signer}
+
+	signer, uid, err := s.findGPGSigner(peer, req.signer)
+	if signer != nil {
+		entry.UID, entry.Key = uid, ssh.FingerprintSHA256(signer.pk)
 	}
 
-	log.Printf("signing data for %s\n", uid)
+	var sig []byte
+	if err == nil {
+		sig, err = s.gpgSign(c, signer, uid, data, req.mode)
+	}
 
-	err := openpgp.ArmoredDetachSign(&buf, signer, bytes.NewReader(data), nil)
+	if err := s.auditRecord(entry, peer, data, err); err != nil {
+		return nil, err
+	}
 
-	return buf.Bytes(), err
+	return sig, err
 }
 
-func (s *SSHAgent) handleGPGRemove(pk ssh.PublicKey) {
-	var gpgkeys []GPGKey
+// findGPGSigner resolves the key specifier spec to a GPG key and one of its
+// uids, loading the configured key file it would be derived from when needed.
+func (s *SSHAgent) findGPGSigner(peer *peerCred, spec string) (*GPGKey, string, error) {
+	s.expireKeys()
 
-	for _, key := range s.gpgkeys {
-		if bytes.Equal(key.pk.Marshal(), pk.Marshal()) {
-			continue
+	c, err := s.resolveGPGKey(spec)
+	if err == nil && c.lk != nil {
+		if err := s.loadLazyKey(c.lk); err != nil {
+			log.Printf("%s: %s\n", c.lk.name, err)
 		}
 
-		gpgkeys = append(gpgkeys, key)
+		c, err = s.resolveGPGKey(spec)
 	}
 
-	s.gpgkeys = gpgkeys
+	if err != nil {
+		log.Printf("refusing GPG signature for %s requested by %s: %s\n", spec, peer, err)
+		return nil, "", err
+	}
+
+	if c.key == nil {
+		log.Printf("no GPG signer found for %s requested by %s\n", spec, peer)
+		return nil, "", errNoSigner
+	}
+
+	return c.key, c.uid, nil
 }
 
-func (s *SSHAgent) handleGPGImport(privateKey interface{}, comment string) error {
-	var gpgkeys []string
+// gpgSign signs data with the GPG key signer for its identity uid in mode for
+// the connection c.
+func (s *SSHAgent) gpgSign(c *connAgent, signer *GPGKey, uid string, data []byte, mode gpgSignMode) ([]byte, error) {
+	peer := c.requestPeer()
 
-	for _, k := range s.v.AllKeys() {
-		if !strings.HasPrefix(k, "gpg.") {
-			continue
+	var buf bytes.Buffer
+
+	if s.gpgKeySetting(signer, "strict") {
+		err := fmt.Errorf("%w: pre-hashed data can't be checked", errNotGitObject)
+		if mode.prehash == 0 {
+			err = checkGitIdentity(signer.uids, data)
 		}
 
-		if !strings.HasSuffix(k, "matchcomment") {
-			continue
+		if err != nil {
+			log.Printf("refusing GPG signature for %s requested by %s: %s\n", uid, peer, err)
+			return nil, err
 		}
+	}
+
+	req := policyRequest{request: gpgSignExtension, peer: peer, pk: signer.pk, uid: uid}
 
-		gpgkeys = append(gpgkeys, strings.ReplaceAll(k, ".matchcomment", ""))
+	if err := s.authorize(req); err != nil {
+		return nil, err
 	}
 
-	for _, key := range gpgkeys {
-		if s.v.GetString(key+".matchcomment") != comment {
-			continue
-		}
+	if err := c.gpgSignerPermitted(signer); err != nil {
+		return nil, err
+	}
 
-		entity, err := s.SSHPrivateKeyToPGP(privateKey, s.v.GetString(key+".name"), s.v.GetString(key+".email"))
-		if err != nil {
-			return err
+	preview := gpgPreview(data)
+	if mode.prehash != 0 {
+		preview = fmt.Sprintf("Pre-hashed %s data, the agent doesn't see what is signed.", hashName(mode.prehash))
+	}
+
+	if s.gpgKeySetting(signer, "confirm") {
+		if err := s.confirm(fmt.Sprintf("Allow a GPG signature for %s?\n\n%s", uid, preview)); err != nil {
+			return nil, err
 		}
+	} else if err := s.confirmKey(signer.pk, fmt.Sprintf("A GPG signature was requested for %s.\n\n%s", uid, preview)); err != nil {
+		return nil, err
+	}
 
-		var pk ssh.PublicKey
+	if err := s.chargeRateLimit(req); err != nil {
+		return nil, err
+	}
 
-		switch key := privateKey.(type) {
-		case *ed25519.PrivateKey:
-			pk, err = ssh.NewPublicKey(ed25519.PublicKey((*key)[32:]))
-			if err != nil {
-				fmt.Println("pk failed", err)
-			}
-		case *gorsa.PrivateKey:
-			pk, err = ssh.NewPublicKey(key.PublicKey)
-			if err != nil {
-				fmt.Println("pk failed", err)
-			}
+	log.Printf("signing data for %s (%s) requested by %s\n", uid, mode, peer)
+
+	err := gpgSignData(&buf, signer.signer, data, mode)
+
+	return buf.Bytes(), err
+}
+
+// gpgKeySetting returns true when a [gpg.*] section of one of the identities
+// of signer sets setting. All identities share one key, so asking for another
+// identity mustn't get around the settings of a section.
+func (s *SSHAgent) gpgKeySetting(signer *GPGKey, setting string) bool {
+	for _, section := range signer.sections {
+		if s.v.GetBool(section + "." + setting) {
+			return true
 		}
+	}
+
+	return false
+}
+
+// checkGitIdentity makes sure data is a git commit or tag of which the committer
+// or tagger is one of the identities uids.
+func checkGitIdentity(uids []string, data []byte) error {
+	obj, ok := parseGitObject(data)
+	if !ok {
+		return errNotGitObject
+	}
+
+	ident := obj.committer
+	if obj.kind == "tag" {
+		ident = obj.tagger
+	}
+
+	id, _ := gitIdent(ident)
+
+	name, email, ok := splitGitIdent(id)
+	if !ok {
+		return fmt.Errorf("%w: %s %s", errIdentityMismatch, obj.kind, id)
+	}
 
-		if entity != nil {
-			s.gpgkeys = append(s.gpgkeys, GPGKey{
-				signer: entity,
-				pk:     pk,
-			})
+	for _, uid := range uids {
+		uidName, uidEmail, _ := splitGitIdent(uid)
+		if name == uidName && strings.EqualFold(email, uidEmail) {
+			return nil
 		}
+	}
 
-		if err != nil {
-			fmt.Println("ssh private key failed", err)
+	return fmt.Errorf("%w: %s %s", errIdentityMismatch, obj.kind, id)
+}
+
+func (s *SSHAgent) handleGPGRemove(pk ssh.PublicKey) {
+	var gpgkeys []GPGKey
+
+	// GPG identities are derived from the private key, not from the certificate
+	if cert, ok := pk.(*ssh.Certificate); ok {
+		pk = cert.Key
+	}
+
+	s.keysMutex.Lock()
+	defer s.keysMutex.Unlock()
+
+	for _, key := range s.gpgkeys {
+		if bytes.Equal(key.pk.Marshal(), pk.Marshal()) {
+			continue
 		}
+
+		gpgkeys = append(gpgkeys, key)
 	}
 
-	return nil
+	s.gpgkeys = gpgkeys
 }
 
-func (s *SSHAgent) SSHPrivateKeyToPGP(privateKey interface{}, name, email string) (*openpgp.Entity, error) {
+func (s *SSHAgent) SSHPrivateKeyToPGP(privateKey interface{}, opts gpgKeyOptions) (*openpgp.Entity, error) {
 	config := &packet.Config{
 		Algorithm:     packet.PubKeyAlgoEdDSA,
 		DefaultHash:   crypto.SHA256,
@@ -131,7 +218,7 @@ func (s *SSHAgent) SSHPrivateKeyToPGP(privateKey interface{}, name, email string
 
 	var primary *packet.PrivateKey
 
-	timeNull := time.Unix(0, 0)
+	timeNull := gpgKeyCreationTime
 
 	switch key := privateKey.(type) {
 	case *ed25519.PrivateKey:
@@ -149,79 +236,112 @@ func (s *SSHAgent) SSHPrivateKeyToPGP(privateKey interface{}, name, email string
 		}
 		config.Algorithm = packet.PubKeyAlgoRSA
 		primary = packet.NewSignerPrivateKey(timeNull, newkey)
+	case *ecdsa.PrivateKey:
+		hash, err := ecdsaHash(key.Curve)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Algorithm = packet.PubKeyAlgoECDSA
+		config.DefaultHash = hash
+		primary = packet.NewSignerPrivateKey(timeNull, key)
 	default:
 		return nil, fmt.Errorf("not supported key %T", privateKey)
 	}
 
+	if fp := fmt.Sprintf("%X", primary.PublicKey.Fingerprint); opts.fingerprint != "" && fp != opts.fingerprint {
+		log.Printf("refusing GPG key %s for %s: expected fingerprint %s\n", fp, strings.Join(opts.uids, ", "), opts.fingerprint)
+		return nil, fmt.Errorf("%w: got %s, expected %s", errFingerprintMismatch, fp, opts.fingerprint)
+	}
+
+	if len(opts.hashes) > 0 {
+		config.DefaultHash = opts.hashes[0]
+	}
+
+	// the lifetime counts from the creation time
 	keyLifetimeSecs := config.KeyLifetime()
+	if !opts.expires.IsZero() {
+		keyLifetimeSecs = uint32(opts.expires.Sub(timeNull).Seconds())
+	}
 
-	uid := packet.NewUserId(name, "", email)
-	if uid == nil {
-		return nil, errors.New("user id field contained invalid characters")
+	if len(opts.uids) == 0 {
+		return nil, errors.New("no user id")
 	}
 
 	if config != nil && config.V5Keys {
 		primary.UpgradeToV5()
 	}
 
-	isPrimaryID := true
-	selfSignature := &packet.Signature{
-		Version:           primary.PublicKey.Version,
-		SigType:           packet.SigTypePositiveCert,
-		PubKeyAlgo:        primary.PublicKey.PubKeyAlgo,
-		Hash:              config.Hash(),
-		CreationTime:      timeNull,
-		KeyLifetimeSecs:   &keyLifetimeSecs,
-		IssuerKeyId:       &primary.PublicKey.KeyId,
-		IssuerFingerprint: primary.PublicKey.Fingerprint,
-		IsPrimaryId:       &isPrimaryID,
-		FlagsValid:        true,
-		FlagSign:          true,
-		FlagCertify:       true,
-		MDC:               true, // true by default, see 5.8 vs. 5.14
-		AEAD:              config.AEAD() != nil,
-		V5Keys:            config != nil && config.V5Keys,
+	entity := &openpgp.Entity{
+		PrimaryKey: &primary.PublicKey,
+		PrivateKey: primary,
+		Identities: make(map[string]*openpgp.Identity),
 	}
 
-	// Set the PreferredHash for the SelfSignature from the packet.Config.
-	// If it is not the must-implement algorithm from rfc4880bis, append that.
-	selfSignature.PreferredHash = []uint8{hashToHashID(config.Hash())}
-	if config.Hash() != crypto.SHA256 {
-		selfSignature.PreferredHash = append(selfSignature.PreferredHash, hashToHashID(crypto.SHA256))
-	}
+	for i, id := range opts.uids {
+		name, email, _ := splitGitIdent(id)
 
-	// Likewise for DefaultCipher.
-	selfSignature.PreferredSymmetric = []uint8{uint8(config.Cipher())}
-	if config.Cipher() != packet.CipherAES128 {
-		selfSignature.PreferredSymmetric = append(selfSignature.PreferredSymmetric, uint8(packet.CipherAES128))
-	}
+		uid := packet.NewUserId(name, "", email)
+		if uid == nil {
+			return nil, errors.New("user id field contained invalid characters")
+		}
 
-	// And for DefaultMode.
-	selfSignature.PreferredAEAD = []uint8{uint8(config.AEAD().Mode())}
-	if config.AEAD().Mode() != packet.AEADModeEAX {
-		selfSignature.PreferredAEAD = append(selfSignature.PreferredAEAD, uint8(packet.AEADModeEAX))
-	}
+		isPrimaryID := i == 0
+		selfSignature := &packet.Signature{
+			Version:           primary.PublicKey.Version,
+			SigType:           packet.SigTypePositiveCert,
+			PubKeyAlgo:        primary.PublicKey.PubKeyAlgo,
+			Hash:              config.Hash(),
+			CreationTime:      timeNull,
+			KeyLifetimeSecs:   &keyLifetimeSecs,
+			IssuerKeyId:       &primary.PublicKey.KeyId,
+			IssuerFingerprint: primary.PublicKey.Fingerprint,
+			IsPrimaryId:       &isPrimaryID,
+			FlagsValid:        true,
+			FlagSign:          true,
+			FlagCertify:       true,
+			MDC:               true, // true by default, see 5.8 vs. 5.14
+			AEAD:              config.AEAD() != nil,
+			V5Keys:            config != nil && config.V5Keys,
+		}
 
-	// User ID binding signature
-	err := selfSignature.SignUserId(uid.Id, &primary.PublicKey, primary, config)
-	if err != nil {
-		return nil, err
-	}
+		// Set the PreferredHash for the SelfSignature from the configured
+		// hashes or the packet.Config. If it is not the must-implement
+		// algorithm from rfc4880bis, append that.
+		selfSignature.PreferredHash = []uint8{hashToHashID(config.Hash())}
+		for _, h := range append(opts.hashes, crypto.SHA256) {
+			if id := hashToHashID(h); !containsHash(selfSignature.PreferredHash, id) {
+				selfSignature.PreferredHash = append(selfSignature.PreferredHash, id)
+			}
+		}
 
-	entity := &openpgp.Entity{
-		PrimaryKey: &primary.PublicKey,
-		PrivateKey: primary,
-		Identities: map[string]*openpgp.Identity{
-			uid.Id: {
-				Name:          uid.Id,
-				UserId:        uid,
-				SelfSignature: selfSignature,
-				Signatures:    []*packet.Signature{selfSignature},
-			},
-		},
+		// Likewise for DefaultCipher.
+		selfSignature.PreferredSymmetric = []uint8{uint8(config.Cipher())}
+		if config.Cipher() != packet.CipherAES128 {
+			selfSignature.PreferredSymmetric = append(selfSignature.PreferredSymmetric, uint8(packet.CipherAES128))
+		}
+
+		// And for DefaultMode.
+		selfSignature.PreferredAEAD = []uint8{uint8(config.AEAD().Mode())}
+		if config.AEAD().Mode() != packet.AEADModeEAX {
+			selfSignature.PreferredAEAD = append(selfSignature.PreferredAEAD, uint8(packet.AEADModeEAX))
+		}
+
+		// User ID binding signature
+		err := selfSignature.SignUserId(uid.Id, &primary.PublicKey, primary, config)
+		if err != nil {
+			return nil, err
+		}
+
+		entity.Identities[uid.Id] = &openpgp.Identity{
+			Name:          uid.Id,
+			UserId:        uid,
+			SelfSignature: selfSignature,
+			Signatures:    []*packet.Signature{selfSignature},
+		}
 	}
 
-	log.Println("adding public key for", uid.Id)
+	log.Println("adding public key for", strings.Join(opts.uids, ", "))
 
 	writer, err := armor.Encode(os.Stderr, openpgp.PublicKeyType, make(map[string]string))
 	if err != nil {
@@ -230,11 +350,36 @@ func (s *SSHAgent) SSHPrivateKeyToPGP(privateKey interface{}, name, email string
 
 	entity.Serialize(writer)
 	writer.Close()
-	fmt.Fprintln(os.Stderr, "\n")
+	fmt.Fprint(os.Stderr, "\n\n")
 
 	return entity, nil
 }
 
+func containsHash(ids []uint8, id uint8) bool {
+	for _, h := range ids {
+		if h == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ecdsaHash returns the hash matching the size of curve, see section 13.2 of
+// RFC 6637.
+func ecdsaHash(curve elliptic.Curve) (crypto.Hash, error) {
+	switch curve {
+	case elliptic.P256():
+		return crypto.SHA256, nil
+	case elliptic.P384():
+		return crypto.SHA384, nil
+	case elliptic.P521():
+		return crypto.SHA512, nil
+	default:
+		return 0, fmt.Errorf("not supported curve %s", curve.Params().Name)
+	}
+}
+
 func hashToHashID(h crypto.Hash) uint8 {
 	v, ok := s2k.HashToHashId(h)
 	if !ok {
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	gorsa "crypto/rsa"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/ProtonMail/go-crypto/rsa"
+	"golang.org/x/crypto/ssh"
+)
+
+// gpgKeyCreationTime is the creation time of the derived OpenPGP keys, it is
+// fixed so the fingerprint only depends on the ssh key.
+var gpgKeyCreationTime = time.Unix(0, 0)
+
+var errFingerprintMismatch = errors.New("GPG fingerprint doesn't match the pinned fingerprint")
+
+// gpgKeyOptions are the settings of the OpenPGP key derived from an ssh key,
+// taken from the [gpg.*] sections matching the key.
+type gpgKeyOptions struct {
+	uids        []string          // the first one is the primary uid
+	sections    map[string]string // uid -> [gpg.*] section
+	expires     time.Time
+	hashes      []crypto.Hash
+	fingerprint string
+}
+
+// gpgKeyOptions merges the settings of sections. The uid of the section with
+// primary=true, or else of the first section, is the primary uid and the key
+// settings come from that section.
+func (s *SSHAgent) gpgKeyOptions(sections []string) (gpgKeyOptions, error) {
+	opts := gpgKeyOptions{sections: make(map[string]string)}
+
+	sections = append([]string(nil), sections...)
+	sort.SliceStable(sections, func(i, j int) bool {
+		return s.v.GetBool(sections[i]+".primary") && !s.v.GetBool(sections[j]+".primary")
+	})
+
+	for _, section := range sections {
+		uids, err := s.gpgSectionUIDs(section)
+		if err != nil {
+			return opts, err
+		}
+
+		for _, uid := range uids {
+			if _, ok := opts.sections[uid]; ok {
+				continue
+			}
+
+			opts.uids = append(opts.uids, uid)
+			opts.sections[uid] = section
+		}
+
+		fp := strings.ToUpper(strings.ReplaceAll(strings.TrimPrefix(s.v.GetString(section+".fingerprint"), "0x"), " ", ""))
+		if fp == "" {
+			continue
+		}
+
+		if opts.fingerprint != "" && opts.fingerprint != fp {
+			return opts, fmt.Errorf("%s: fingerprint %s differs from the fingerprint %s of another section matching the key", section, fp, opts.fingerprint)
+		}
+
+		opts.fingerprint = fp
+	}
+
+	if len(sections) == 0 {
+		return opts, nil
+	}
+
+	primary := sections[0]
+
+	if expires := s.v.GetString(primary + ".expires"); expires != "" {
+		t, err := parseGPGExpires(expires)
+		if err != nil {
+			return opts, fmt.Errorf("%s: invalid expires %s", primary, expires)
+		}
+
+		// the key lifetime is an uint32 of seconds since the key creation
+		if !t.After(gpgKeyCreationTime) || t.Sub(gpgKeyCreationTime) > math.MaxUint32*time.Second {
+			return opts, fmt.Errorf("%s: expires %s isn't between %s and %s", primary, expires,
+				gpgKeyCreationTime.UTC().Format(time.RFC3339), gpgKeyCreationTime.Add(math.MaxUint32*time.Second).UTC().Format(time.RFC3339))
+		}
+
+		opts.expires = t
+	}
+
+	for _, name := range s.configStrings(primary + ".hashes") {
+		h, ok := gpgHashes[strings.ToLower(name)]
+		if !ok {
+			return opts, fmt.Errorf("%s: unsupported hash %s", primary, name)
+		}
+
+		opts.hashes = append(opts.hashes, h)
+	}
+
+	return opts, nil
+}
+
+// gpgSectionUIDs returns the uid of the name and email of section followed by
+// its additional uids.
+func (s *SSHAgent) gpgSectionUIDs(section string) ([]string, error) {
+	idents := [][2]string{{s.v.GetString(section + ".name"), s.v.GetString(section + ".email")}}
+
+	for _, uid := range s.configStrings(section + ".uids") {
+		name, email, ok := splitGitIdent(uid)
+		if !ok {
+			return nil, fmt.Errorf("%s: uid %q isn't \"name <email>\"", section, uid)
+		}
+
+		idents = append(idents, [2]string{name, email})
+	}
+
+	var uids []string
+
+	for _, ident := range idents {
+		id := packet.NewUserId(ident[0], "", ident[1])
+		if id == nil {
+			return nil, fmt.Errorf("%s: user id %s <%s> contains invalid characters", section, ident[0], ident[1])
+		}
+
+		uids = append(uids, id.Id)
+	}
+
+	return uids, nil
+}
+
+func parseGPGExpires(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+// gpgFingerprint returns the fingerprint of the OpenPGP key derived from pk.
+func gpgFingerprint(pk ssh.PublicKey) (string, error) {
+	if cert, ok := pk.(*ssh.Certificate); ok {
+		pk = cert.Key
+	}
+
+	cpk, ok := pk.(ssh.CryptoPublicKey)
+	if !ok {
+		return "", fmt.Errorf("not supported key %s", pk.Type())
+	}
+
+	var pub *packet.PublicKey
+
+	switch key := cpk.CryptoPublicKey().(type) {
+	case ed25519.PublicKey:
+		pub = packet.NewEdDSAPublicKey(gpgKeyCreationTime, &key)
+	case *gorsa.PublicKey:
+		pub = packet.NewRSAPublicKey(gpgKeyCreationTime, &rsa.PublicKey{N: key.N, E: key.E})
+	case *ecdsa.PublicKey:
+		if _, err := ecdsaHash(key.Curve); err != nil {
+			return "", err
+		}
+
+		pub = packet.NewECDSAPublicKey(gpgKeyCreationTime, key)
+	default:
+		return "", fmt.Errorf("not supported key %s", pk.Type())
+	}
+
+	return fmt.Sprintf("%X", pub.Fingerprint), nil
+}
+
+// checkGPGFingerprints checks the pinned fingerprints of the GPG keys that
+// would be derived from the keys in the agent and the key files.
+func (s *SSHAgent) checkGPGFingerprints() error {
+	var keys []gpgMatchKey
+
+	s.keysMutex.RLock()
+	for _, info := range s.keys {
+		keys = append(keys, newGPGMatchKey(info.pk, info.comment))
+	}
+
+	for _, lk := range s.lazykeys {
+		keys = append(keys, newGPGMatchKey(lk.pk, lk.comment))
+	}
+	s.keysMutex.RUnlock()
+
+	for _, k := range keys {
+		opts, err := s.gpgKeyOptions(s.gpgMatchingSections(k))
+		if err != nil {
+			return err
+		}
+
+		if opts.fingerprint == "" {
+			continue
+		}
+
+		fp, err := gpgFingerprint(k.pk)
+		if err != nil {
+			return fmt.Errorf("%s: %w", ssh.FingerprintSHA256(k.pk), err)
+		}
+
+		if fp != opts.fingerprint {
+			return fmt.Errorf("%w: %s derives %s, expected %s", errFingerprintMismatch, ssh.FingerprintSHA256(k.pk), fp, opts.fingerprint)
+		}
+	}
+
+	return nil
+}
+
+// gpgMatchKeys returns the match keys of pk and of the other keys in the
+// keyring that are certificates for the same key, and the private key.
+func (s *SSHAgent) gpgMatchKeys(pk ssh.PublicKey) ([]gpgMatchKey, interface{}) {
+	var (
+		keys       []gpgMatchKey
+		privateKey interface{}
+	)
+
+	k := newGPGMatchKey(pk, "")
+
+	s.keysMutex.RLock()
+	defer s.keysMutex.RUnlock()
+
+	for _, info := range s.keys {
+		mk := newGPGMatchKey(info.pk, info.comment)
+		if !bytes.Equal(mk.pk.Marshal(), k.pk.Marshal()) {
+			continue
+		}
+
+		keys = append(keys, mk)
+		privateKey = info.added.PrivateKey
+	}
+
+	return keys, privateKey
+}
+
+// gpgKeySections returns the [gpg.*] sections matching one of keys, which
+// are certificates of the same key or the key itself.
+func (s *SSHAgent) gpgKeySections(keys []gpgMatchKey) []string {
+	var sections []string
+
+	seen := make(map[string]bool)
+
+	for _, k := range keys {
+		for _, section := range s.gpgMatchingSections(k) {
+			if !seen[section] {
+				seen[section] = true
+				sections = append(sections, section)
+			}
+		}
+	}
+
+	sort.Strings(sections)
+
+	return sections
+}
+
+// checkGPGFingerprint checks the pinned fingerprint of the GPG key that would
+// be derived when pk with comment is added to the keyring.
+func (s *SSHAgent) checkGPGFingerprint(pk ssh.PublicKey, comment string) error {
+	var keys []gpgMatchKey
+
+	all, _ := s.gpgMatchKeys(pk)
+
+	// the entry of pk itself is replaced
+	for _, k := range all {
+		full := k.pk
+		if k.cert != nil {
+			full = k.cert
+		}
+
+		if !bytes.Equal(full.Marshal(), pk.Marshal()) {
+			keys = append(keys, k)
+		}
+	}
+
+	keys = append(keys, newGPGMatchKey(pk, comment))
+
+	// other errors are logged when the GPG key is derived
+	opts, err := s.gpgKeyOptions(s.gpgKeySections(keys))
+	if err != nil || opts.fingerprint == "" {
+		return nil
+	}
+
+	fp, err := gpgFingerprint(pk)
+	if err != nil {
+		return nil
+	}
+
+	if fp != opts.fingerprint {
+		log.Printf("refusing %s: GPG key %s for %s, expected fingerprint %s\n", ssh.FingerprintSHA256(pk), fp, strings.Join(opts.uids, ", "), opts.fingerprint)
+		return fmt.Errorf("%w: got %s, expected %s", errFingerprintMismatch, fp, opts.fingerprint)
+	}
+
+	return nil
+}
+
+// handleGPGImport derives the GPG key of the ssh key pk, which may be a
+// certificate. It gets the identities of the [gpg.*] sections matching the
+// key or a certificate of it in the keyring, and replaces the GPG key derived
+// before.
+func (s *SSHAgent) handleGPGImport(pk ssh.PublicKey) error {
+	keys, privateKey := s.gpgMatchKeys(pk)
+
+	s.handleGPGRemove(pk)
+
+	if privateKey == nil {
+		return nil
+	}
+
+	sections := s.gpgKeySections(keys)
+	if len(sections) == 0 {
+		return nil
+	}
+
+	opts, err := s.gpgKeyOptions(sections)
+	if err != nil {
+		return err
+	}
+
+	entity, err := s.SSHPrivateKeyToPGP(privateKey, opts)
+	if err != nil {
+		return err
+	}
+
+	s.keysMutex.Lock()
+	s.gpgkeys = append(s.gpgkeys, GPGKey{
+		signer:   entity,
+		pk:       keys[0].pk,
+		uids:     opts.uids,
+		sections: opts.sections,
+	})
+	s.keysMutex.Unlock()
+
+	return nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestGPGKeyOptionsExpires(t *testing.T) {
+	tests := []struct {
+		expires string
+		want    time.Time
+		ok      bool
+	}{
+		{"2030-01-01", time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), true},
+		{"2030-01-01T12:00:00Z", time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC), true},
+		{"2106-02-07T06:28:15Z", time.Unix(1<<32-1, 0), true},
+		{"2106-02-07T06:28:16Z", time.Time{}, false},
+		{"2200-01-01", time.Time{}, false},
+		{"1970-01-01", time.Time{}, false},
+		{"1969-12-31", time.Time{}, false},
+		{"tomorrow", time.Time{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expires, func(t *testing.T) {
+			s := newTestAgent(t, fmt.Sprintf("[gpg.a]\nname=\"A\"\nemail=\"a@x\"\nexpires=%q\n", tt.expires))
+
+			opts, err := s.gpgKeyOptions([]string{"gpg.a"})
+			if (err == nil) != tt.ok {
+				t.Fatalf("gpgKeyOptions() error = %v, want ok %v", err, tt.ok)
+			}
+
+			if tt.ok && !opts.expires.Equal(tt.want) {
+				t.Errorf("expires = %s, want %s", opts.expires, tt.want)
+			}
+		})
+	}
+}
+
+func TestGPGKeyOptionsMerge(t *testing.T) {
+	s := newTestAgent(t, `
+[gpg.a]
+name="A"
+email="a@x"
+uids=["A Work <a@work>"]
+[gpg.b]
+name="B"
+email="b@x"
+primary=true
+hashes=["sha512", "sha256"]
+fingerprint="0x9be9 db4e 9ee7 4fa2 ad4c f0db c8b6 2e26 a711 3e29"
+[gpg.c]
+name="C"
+email="c@x"
+fingerprint="51F6EA057EB5146D06029896DE8A6898EE572905"
+`)
+
+	opts, err := s.gpgKeyOptions([]string{"gpg.a", "gpg.b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"B <b@x>", "A <a@x>", "A Work <a@work>"}
+	if strings.Join(opts.uids, ", ") != strings.Join(want, ", ") {
+		t.Errorf("uids = %q, want %q", opts.uids, want)
+	}
+
+	if opts.sections["A Work <a@work>"] != "gpg.a" || opts.sections["B <b@x>"] != "gpg.b" {
+		t.Errorf("sections = %v", opts.sections)
+	}
+
+	if opts.fingerprint != "9BE9DB4E9EE74FA2AD4CF0DBC8B62E26A7113E29" {
+		t.Errorf("fingerprint = %s", opts.fingerprint)
+	}
+
+	if len(opts.hashes) != 2 {
+		t.Errorf("hashes = %v", opts.hashes)
+	}
+
+	if _, err := s.gpgKeyOptions([]string{"gpg.b", "gpg.c"}); err == nil {
+		t.Error("gpgKeyOptions() accepted sections with different fingerprints")
+	}
+}
+
+func TestGPGKeySetting(t *testing.T) {
+	s := newTestAgent(t, `
+[gpg.a]
+name="A"
+email="a@x"
+[gpg.b]
+name="B"
+email="b@x"
+strict=true
+`)
+
+	signer := &GPGKey{sections: map[string]string{"A <a@x>": "gpg.a", "B <b@x>": "gpg.b"}}
+
+	if !s.gpgKeySetting(signer, "strict") {
+		t.Error("strict of gpg.b doesn't hold for the identity of gpg.a")
+	}
+
+	if s.gpgKeySetting(signer, "confirm") {
+		t.Error("confirm is set without a section setting it")
+	}
+}
+
+func TestCheckGitIdentity(t *testing.T) {
+	uids := []string{"bob <bob@example.com>", "alice <Alice@Example.com>"}
+
+	if err := checkGitIdentity(uids, testObject("tree "+testTree, "author "+testAlice, "committer "+testAlice)); err != nil {
+		t.Errorf("checkGitIdentity() of a commit by alice error = %v", err)
+	}
+
+	if err := checkGitIdentity(uids, testObject("tree "+testTree, "author "+testAlice, "committer "+testMallet)); !errors.Is(err, errIdentityMismatch) {
+		t.Errorf("checkGitIdentity() of a commit by mallet error = %v, want %v", err, errIdentityMismatch)
+	}
+
+	if err := checkGitIdentity(uids, []byte("data")); !errors.Is(err, errNotGitObject) {
+		t.Errorf("checkGitIdentity() of other data error = %v, want %v", err, errNotGitObject)
+	}
+}
+
+func TestSSHPrivateKeyToPGP(t *testing.T) {
+	s := newTestAgent(t, "")
+
+	key, pk := testEd25519Key(t, 1)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecPK, err := ssh.NewPublicKey(&ecKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, tt := range []struct {
+		name       string
+		privateKey interface{}
+		pk         ssh.PublicKey
+	}{
+		{"ed25519", key, pk},
+		{"ecdsa", ecKey, ecPK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := gpgFingerprint(tt.pk)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the fingerprint only depends on the key, not on the identities
+			for _, uids := range [][]string{{"A <a@x>"}, {"B <b@x>", "A <a@x>"}} {
+				entity, err := s.SSHPrivateKeyToPGP(tt.privateKey, gpgKeyOptions{uids: uids, expires: expires})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if fp := fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint); fp != want {
+					t.Errorf("fingerprint of %q = %s, want %s", uids, fp, want)
+				}
+
+				id := entity.PrimaryIdentity()
+				if id.Name != uids[0] {
+					t.Errorf("primary identity = %s, want %s", id.Name, uids[0])
+				}
+
+				if got := *id.SelfSignature.KeyLifetimeSecs; got != uint32(expires.Unix()) {
+					t.Errorf("key lifetime = %d, want %d", got, expires.Unix())
+				}
+
+				if entity.PrimaryKey.KeyExpired(id.SelfSignature, expires) || !entity.PrimaryKey.KeyExpired(id.SelfSignature, expires.Add(time.Second)) {
+					t.Errorf("key doesn't expire at %s", expires)
+				}
+			}
+		})
+	}
+
+	if _, err := s.SSHPrivateKeyToPGP(key, gpgKeyOptions{uids: []string{"A <a@x>"}, fingerprint: strings.Repeat("0", 40)}); !errors.Is(err, errFingerprintMismatch) {
+		t.Errorf("SSHPrivateKeyToPGP() with another fingerprint error = %v, want %v", err, errFingerprintMismatch)
+	}
+}
+
+func TestGPGFingerprintStable(t *testing.T) {
+	// derived from the ed25519 key with seed 1, this must never change or
+	// users lose their published keys
+	const want = "582749FA33BF7090B0250E840285189203367A4F"
+
+	_, pk := testEd25519Key(t, 1)
+
+	fp, err := gpgFingerprint(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fp != want {
+		t.Errorf("gpgFingerprint() = %s, want %s", fp, want)
+	}
+}
+
+func TestAddFingerprintMismatch(t *testing.T) {
+	s := newTestAgent(t, `
+[gpg.good]
+name="A"
+email="a@x"
+matchcomment="good"
+fingerprint="582749FA33BF7090B0250E840285189203367A4F"
+[gpg.bad]
+name="B"
+email="b@x"
+matchcomment="bad"
+fingerprint="0000000000000000000000000000000000000000"
+`)
+
+	key, pk := testEd25519Key(t, 1)
+
+	if err := s.Add(agent.AddedKey{PrivateKey: key, Comment: "good"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// adding the loaded key again with a comment that gets another pinned
+	// fingerprint must keep the loaded copy
+	if err := s.Add(agent.AddedKey{PrivateKey: key, Comment: "bad"}); !errors.Is(err, errFingerprintMismatch) {
+		t.Fatalf("Add() error = %v, want %v", err, errFingerprintMismatch)
+	}
+
+	keys, err := s.ExtendedAgent.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 1 || keys[0].Comment != "good" {
+		t.Errorf("keyring = %v, want the key with comment good", keys)
+	}
+
+	if info := s.keys[string(pk.Marshal())]; info == nil || info.comment != "good" {
+		t.Errorf("key info = %v, want the key with comment good", info)
+	}
+
+	if len(s.gpgkeys) != 1 || s.gpgkeys[0].uids[0] != "A <a@x>" {
+		t.Errorf("gpg keys = %v, want A <a@x>", s.gpgkeys)
+	}
+
+	s.v.Set("gpg.good.fingerprint", strings.Repeat("1", 40))
+
+	if err := s.checkGPGFingerprints(); !errors.Is(err, errFingerprintMismatch) {
+		t.Errorf("checkGPGFingerprints() error = %v, want %v", err, errFingerprintMismatch)
+	}
+}
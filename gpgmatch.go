@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Match levels of the rules of a [gpg.*] section, from the least to the most
+// specific. A key only gets the identities of the sections matching it on the
+// most specific level.
+const (
+	gpgMatchNone = iota
+	gpgMatchCommentRegex
+	gpgMatchCommentGlob
+	gpgMatchComment
+	gpgMatchCertificate
+	gpgMatchFingerprint
+)
+
+// gpgMatchRules are the settings of a [gpg.*] section that bind it to keys.
+var gpgMatchRules = []string{
+	"matchfingerprint",
+	"matchkeyid",
+	"matchprincipal",
+	"matchcomment",
+	"matchcommentglob",
+	"matchcommentregex",
+}
+
+// gpgMatchKey is what the rules of the [gpg.*] sections are matched against.
+type gpgMatchKey struct {
+	pk      ssh.PublicKey
+	comment string
+	cert    *ssh.Certificate
+}
+
+// newGPGMatchKey returns the match key of pk, which may be a certificate.
+func newGPGMatchKey(pk ssh.PublicKey, comment string) gpgMatchKey {
+	k := gpgMatchKey{pk: pk, comment: comment}
+
+	if cert, ok := pk.(*ssh.Certificate); ok {
+		k.pk, k.cert = cert.Key, cert
+	}
+
+	return k
+}
+
+// gpgSections returns the [gpg.*] config sections.
+func (s *SSHAgent) gpgSections() []string {
+	var gpgkeys []string
+
+	seen := make(map[string]bool)
+
+	for _, k := range s.v.AllKeys() {
+		if !strings.HasPrefix(k, "gpg.") {
+			continue
+		}
+
+		i := strings.LastIndex(k, ".")
+		section, rule := k[:i], k[i+1:]
+
+		if seen[section] || !containsString(gpgMatchRules, rule) {
+			continue
+		}
+
+		seen[section] = true
+		gpgkeys = append(gpgkeys, section)
+	}
+
+	sort.Strings(gpgkeys)
+
+	return gpgkeys
+}
+
+// gpgMatchingSections returns the [gpg.*] sections that bind k.
+func (s *SSHAgent) gpgMatchingSections(k gpgMatchKey) []string {
+	var (
+		sections []string
+		best     = gpgMatchNone
+	)
+
+	for _, section := range s.gpgSections() {
+		level := s.gpgMatch(section, k)
+		if level == gpgMatchNone || level < best {
+			continue
+		}
+
+		if level > best {
+			best, sections = level, nil
+		}
+
+		sections = append(sections, section)
+	}
+
+	return sections
+}
+
+// gpgMatch returns the most specific level on which section matches k.
+func (s *SSHAgent) gpgMatch(section string, k gpgMatchKey) int {
+	if k.pk != nil {
+		fp := ssh.FingerprintSHA256(k.pk)
+
+		for _, want := range s.configStrings(section + ".matchfingerprint") {
+			if !strings.HasPrefix(want, "SHA256:") {
+				want = "SHA256:" + want
+			}
+
+			if want == fp {
+				return gpgMatchFingerprint
+			}
+		}
+	}
+
+	if k.cert != nil {
+		if containsString(s.configStrings(section+".matchkeyid"), k.cert.KeyId) {
+			return gpgMatchCertificate
+		}
+
+		for _, principal := range s.configStrings(section + ".matchprincipal") {
+			if containsString(k.cert.ValidPrincipals, principal) {
+				return gpgMatchCertificate
+			}
+		}
+	}
+
+	if containsString(s.configStrings(section+".matchcomment"), k.comment) {
+		return gpgMatchComment
+	}
+
+	for _, pattern := range s.configStrings(section + ".matchcommentglob") {
+		if matchPattern(pattern, k.comment) {
+			return gpgMatchCommentGlob
+		}
+	}
+
+	for _, expr := range s.configStrings(section + ".matchcommentregex") {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			log.Printf("%s: invalid matchcommentregex %q: %s\n", section, expr, err)
+			continue
+		}
+
+		if re.MatchString(k.comment) {
+			return gpgMatchCommentRegex
+		}
+	}
+
+	return gpgMatchNone
+}
+
+// checkGPGSections checks the regular expressions of the [gpg.*] sections.
+func (s *SSHAgent) checkGPGSections() error {
+	for _, section := range s.gpgSections() {
+		for _, expr := range s.configStrings(section + ".matchcommentregex") {
+			if _, err := regexp.Compile(expr); err != nil {
+				return fmt.Errorf("%s: invalid matchcommentregex %q: %w", section, expr, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// configStrings returns the string or the list of strings of key.
+func (s *SSHAgent) configStrings(key string) []string {
+	switch v := s.v.Get(key).(type) {
+	case nil:
+		return nil
+	case []string:
+		return v
+	case []interface{}:
+		var list []string
+		for _, e := range v {
+			list = append(list, fmt.Sprint(e))
+		}
+
+		return list
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestGPGMatchingSections(t *testing.T) {
+	_, pk := testEd25519Key(t, 1)
+
+	fp := ssh.FingerprintSHA256(pk)
+
+	s := newTestAgent(t, `
+[gpg.fingerprint]
+name="F"
+email="f@x"
+matchfingerprint="`+strings.TrimPrefix(fp, "SHA256:")+`"
+[gpg.keyid]
+name="K"
+email="k@x"
+matchkeyid="test"
+[gpg.principal]
+name="P"
+email="p@x"
+matchprincipal=["other", "test"]
+[gpg.comment]
+name="C"
+email="c@x"
+matchcomment="me@laptop"
+[gpg.glob]
+name="G"
+email="g@x"
+matchcommentglob=["*@laptop", "work/*"]
+[gpg.regex]
+name="R"
+email="r@x"
+matchcommentregex="^me@"
+`)
+
+	_, other := testEd25519Key(t, 2)
+
+	tests := []struct {
+		pk      ssh.PublicKey
+		comment string
+		want    []string
+	}{
+		{pk, "me@laptop", []string{"gpg.fingerprint"}},
+		{testCertificate(t, pk), "me@laptop", []string{"gpg.fingerprint"}},
+		{testCertificate(t, other), "me@laptop", []string{"gpg.keyid", "gpg.principal"}},
+		{other, "me@laptop", []string{"gpg.comment"}},
+		{other, "you@laptop", []string{"gpg.glob"}},
+		{other, "work/ci/runner", []string{"gpg.glob"}},
+		{other, "me@server", []string{"gpg.regex"}},
+		{other, "you@server", nil},
+	}
+
+	for _, tt := range tests {
+		got := s.gpgMatchingSections(newGPGMatchKey(tt.pk, tt.comment))
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("gpgMatchingSections(%s) = %v, want %v", tt.comment, got, tt.want)
+		}
+	}
+}
+
+func TestCheckGPGSections(t *testing.T) {
+	s := newTestAgent(t, "[gpg.a]\nname=\"A\"\nemail=\"a@x\"\nmatchcommentglob=\"[x\"\n")
+	if err := s.checkGPGSections(); err != nil {
+		t.Errorf("checkGPGSections() error = %v for a glob with [", err)
+	}
+
+	s = newTestAgent(t, "[gpg.a]\nname=\"A\"\nemail=\"a@x\"\nmatchcommentregex=\"([\"\n")
+	if err := s.checkGPGSections(); err == nil {
+		t.Error("checkGPGSections() accepted an invalid regex")
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"encoding"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/ProtonMail/go-crypto/openpgp/s2k"
+)
+
+// Signature modes of the mode option, named after the gpg commands.
+const (
+	gpgModeDetach    = "detach"    // gpg --detach-sign
+	gpgModeClearsign = "clearsign" // gpg --clearsign
+	gpgModeSign      = "sign"      // gpg --sign
+)
+
+// gpgHashes are the hashes by their name in the hash option and the hashes
+// setting.
+var gpgHashes = map[string]crypto.Hash{
+	"sha224": crypto.SHA224,
+	"sha256": crypto.SHA256,
+	"sha384": crypto.SHA384,
+	"sha512": crypto.SHA512,
+}
+
+// gpgSignMode is how the signature is made and written. When prehash is set
+// the data is the state of the prehash hash after hashing the data.
+type gpgSignMode struct {
+	mode    string
+	armor   bool
+	text    bool
+	prehash crypto.Hash
+	created time.Time
+}
+
+// defaultGPGSignMode is an armored detached signature, the only mode of
+// legacy requests.
+var defaultGPGSignMode = gpgSignMode{mode: gpgModeDetach, armor: true}
+
+// parseGPGSignMode parses the mode, armor, textmode, hash and created options.
+func parseGPGSignMode(options map[string]string) (gpgSignMode, error) {
+	m := defaultGPGSignMode
+
+	if mode, ok := options["mode"]; ok {
+		switch mode {
+		case gpgModeDetach, gpgModeClearsign, gpgModeSign:
+			m.mode = mode
+		default:
+			return m, fmt.Errorf("%w: unknown mode %s", errBadRequest, mode)
+		}
+	}
+
+	var err error
+
+	if m.armor, err = parseGPGBoolOption(options, "armor", m.armor); err != nil {
+		return m, err
+	}
+
+	if m.text, err = parseGPGBoolOption(options, "textmode", m.text); err != nil {
+		return m, err
+	}
+
+	// a cleartext signature is always armored and signs the canonical text
+	if m.mode == gpgModeClearsign {
+		m.armor, m.text = true, true
+	}
+
+	if name, ok := options["hash"]; ok {
+		if m.prehash, ok = gpgHashes[name]; !ok {
+			return m, fmt.Errorf("%w: unsupported hash %s", errBadRequest, name)
+		}
+
+		if m.mode != gpgModeDetach {
+			return m, fmt.Errorf("%w: pre-hashed data can only get a detached signature", errBadRequest)
+		}
+	}
+
+	if created, ok := options["created"]; ok {
+		if m.prehash == 0 {
+			return m, fmt.Errorf("%w: created needs pre-hashed data", errBadRequest)
+		}
+
+		secs, err := strconv.ParseUint(created, 10, 32)
+		if err != nil || secs == 0 {
+			return m, fmt.Errorf("%w: invalid creation time %s", errBadRequest, created)
+		}
+
+		m.created = time.Unix(int64(secs), 0)
+	}
+
+	return m, nil
+}
+
+func parseGPGBoolOption(options map[string]string, name string, def bool) (bool, error) {
+	value, ok := options[name]
+	if !ok {
+		return def, nil
+	}
+
+	switch value {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	default:
+		return def, fmt.Errorf("%w: %s must be yes or no", errBadRequest, name)
+	}
+}
+
+func (m gpgSignMode) String() string {
+	s := m.mode
+
+	if m.mode != gpgModeClearsign {
+		if m.armor {
+			s += ", armored"
+		}
+
+		if m.text {
+			s += ", text mode"
+		}
+	}
+
+	if m.prehash != 0 {
+		s += ", pre-hashed " + hashName(m.prehash)
+	}
+
+	return s
+}
+
+// gpgSignData writes the signature of data by signer in mode m to w.
+func gpgSignData(w io.Writer, signer *openpgp.Entity, data []byte, m gpgSignMode) error {
+	if m.prehash != 0 {
+		return prehashSign(w, signer, data, m)
+	}
+
+	config := gpgSignConfig(signer)
+
+	switch m.mode {
+	case gpgModeClearsign:
+		return clearSign(w, signer, data, config)
+	case gpgModeSign:
+		return inlineSign(w, signer, data, m, config)
+	}
+
+	switch {
+	case m.armor && m.text:
+		return openpgp.ArmoredDetachSignText(w, signer, bytes.NewReader(data), config)
+	case m.armor:
+		return openpgp.ArmoredDetachSign(w, signer, bytes.NewReader(data), config)
+	case m.text:
+		return openpgp.DetachSignText(w, signer, bytes.NewReader(data), config)
+	default:
+		return openpgp.DetachSign(w, signer, bytes.NewReader(data), config)
+	}
+}
+
+// gpgSignConfig signs with the preferred hash of the signer, eg SHA-384 for a
+// nistp384 key.
+func gpgSignConfig(signer *openpgp.Entity) *packet.Config {
+	config := &packet.Config{}
+
+	if id := signer.PrimaryIdentity(); id != nil && id.SelfSignature != nil && len(id.SelfSignature.PreferredHash) > 0 {
+		if h, ok := s2k.HashIdToHash(id.SelfSignature.PreferredHash[0]); ok {
+			config.DefaultHash = h
+		}
+	}
+
+	return config
+}
+
+// clearSign writes data dash-escaped followed by a text signature, see
+// section 7 of RFC 4880. Trailing whitespace isn't signed so it is dropped.
+func clearSign(w io.Writer, signer *openpgp.Entity, data []byte, config *packet.Config) error {
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+
+	var sig bytes.Buffer
+
+	if err := openpgp.ArmoredDetachSignText(&sig, signer, strings.NewReader(strings.Join(lines, "\n")), config); err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "-----BEGIN PGP SIGNED MESSAGE-----\nHash: %s\n\n", hashName(config.Hash()))
+
+	for _, line := range lines {
+		if strings.HasPrefix(line, "-") {
+			b.WriteString("- ")
+		}
+
+		b.WriteString(line + "\n")
+	}
+
+	b.Write(sig.Bytes())
+	b.WriteString("\n")
+
+	_, err := w.Write(b.Bytes())
+
+	return err
+}
+
+// inlineSign writes a signed message containing data, like gpg --sign.
+func inlineSign(w io.Writer, signer *openpgp.Entity, data []byte, m gpgSignMode, config *packet.Config) error {
+	out := nopWriteCloser{w}
+
+	var aw io.WriteCloser
+
+	if m.armor {
+		var err error
+
+		aw, err = armor.Encode(w, "PGP MESSAGE", nil)
+		if err != nil {
+			return err
+		}
+
+		out = nopWriteCloser{aw}
+	}
+
+	key := signer.PrivateKey
+	sigHash := config.Hash()
+
+	sigType := packet.SigTypeBinary
+	if m.text {
+		sigType = packet.SigTypeText
+		data = canonicalText(data)
+	}
+
+	ops := &packet.OnePassSignature{
+		SigType:    sigType,
+		Hash:       sigHash,
+		PubKeyAlgo: key.PubKeyAlgo,
+		KeyId:      key.KeyId,
+		IsLast:     true,
+	}
+
+	if err := ops.Serialize(out); err != nil {
+		return err
+	}
+
+	literal, err := packet.SerializeLiteral(out, !m.text, "", 0)
+	if err != nil {
+		return err
+	}
+
+	if _, err := literal.Write(data); err != nil {
+		return err
+	}
+
+	if err := literal.Close(); err != nil {
+		return err
+	}
+
+	h := sigHash.New()
+	h.Write(data)
+
+	sig := &packet.Signature{
+		Version:      key.Version,
+		SigType:      sigType,
+		PubKeyAlgo:   key.PubKeyAlgo,
+		Hash:         sigHash,
+		CreationTime: time.Now(),
+		IssuerKeyId:  &key.KeyId,
+	}
+
+	if err := sig.Sign(h, key, config); err != nil {
+		return err
+	}
+
+	if err := sig.Serialize(out); err != nil {
+		return err
+	}
+
+	if aw != nil {
+		return aw.Close()
+	}
+
+	return nil
+}
+
+// prehashSign writes a detached signature over the data hashed in state by
+// the client.
+func prehashSign(w io.Writer, signer *openpgp.Entity, state []byte, m gpgSignMode) error {
+	key := signer.PrivateKey
+
+	// a hash shorter than the curve weakens the signature, see section 13.2
+	// of RFC 6637
+	if pub, ok := key.PublicKey.PublicKey.(*ecdsa.PublicKey); ok {
+		min, err := ecdsaHash(pub.Curve)
+		if err != nil {
+			return err
+		}
+
+		if m.prehash.Size() < min.Size() {
+			return fmt.Errorf("%w: %s is too short for a %s key, use %s or longer", errBadRequest, hashName(m.prehash), pub.Curve.Params().Name, hashName(min))
+		}
+	}
+
+	h, err := hashState(m.prehash, state)
+	if err != nil {
+		return err
+	}
+
+	sigType := packet.SigTypeBinary
+	if m.text {
+		sigType = packet.SigTypeText
+	}
+
+	created := m.created
+	if created.IsZero() {
+		created = time.Now()
+	}
+
+	sig := &packet.Signature{
+		SigType:      sigType,
+		PubKeyAlgo:   key.PubKeyAlgo,
+		Hash:         m.prehash,
+		CreationTime: created,
+		IssuerKeyId:  &key.KeyId,
+	}
+
+	if err := sig.Sign(h, key, nil); err != nil {
+		return err
+	}
+
+	out := nopWriteCloser{w}
+
+	var aw io.WriteCloser
+
+	if m.armor {
+		if aw, err = armor.Encode(w, openpgp.SignatureType, nil); err != nil {
+			return err
+		}
+
+		out = nopWriteCloser{aw}
+	}
+
+	if err := sig.Serialize(out); err != nil {
+		return err
+	}
+
+	if aw != nil {
+		return aw.Close()
+	}
+
+	return nil
+}
+
+// hashState restores a hash from the state marshalled by the
+// encoding.BinaryMarshaler of a Go hash.
+func hashState(h crypto.Hash, state []byte) (hash.Hash, error) {
+	if !h.Available() {
+		return nil, fmt.Errorf("hash %s isn't available", hashName(h))
+	}
+
+	hh := h.New()
+
+	u, ok := hh.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return nil, fmt.Errorf("hash %s can't be restored", hashName(h))
+	}
+
+	if err := u.UnmarshalBinary(state); err != nil {
+		return nil, fmt.Errorf("%w: invalid %s state: %s", errBadRequest, hashName(h), err)
+	}
+
+	return hh, nil
+}
+
+// canonicalText converts the line endings of data to CRLF.
+func canonicalText(data []byte) []byte {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+
+	return bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+}
+
+// hashName is the name of h in the Hash header of a cleartext signature.
+func hashName(h crypto.Hash) string {
+	switch h {
+	case crypto.SHA1:
+		return "SHA1"
+	case crypto.SHA224:
+		return "SHA224"
+	case crypto.SHA256:
+		return "SHA256"
+	case crypto.SHA384:
+		return "SHA384"
+	case crypto.SHA512:
+		return "SHA512"
+	default:
+		return h.String()
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// testGPGKeys returns the keys to sign with by name.
+func testGPGKeys(t *testing.T) map[string]interface{} {
+	t.Helper()
+
+	key, _ := testEd25519Key(t, 1)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := map[string]interface{}{
+		"ed25519": key,
+		"rsa":     rsaKey,
+	}
+
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384()} {
+		ecKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys["ecdsa "+curve.Params().Name] = ecKey
+	}
+
+	return keys
+}
+
+func TestGPGSignData(t *testing.T) {
+	s := newTestAgent(t, "")
+
+	data := []byte("first line\nsecond line with trailing space \n-dash\n")
+
+	for name, key := range testGPGKeys(t) {
+		entity, err := s.SSHPrivateKeyToPGP(key, gpgKeyOptions{uids: []string{"alice <alice@example.com>"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keyring := openpgp.EntityList{entity}
+
+		t.Run(name+" detached text", func(t *testing.T) {
+			for _, armored := range []bool{true, false} {
+				var sig bytes.Buffer
+
+				if err := gpgSignData(&sig, entity, data, gpgSignMode{mode: gpgModeDetach, armor: armored, text: true}); err != nil {
+					t.Fatal(err)
+				}
+
+				check := openpgp.CheckDetachedSignature
+				if armored {
+					check = openpgp.CheckArmoredDetachedSignature
+				}
+
+				// a text signature doesn't depend on the line endings
+				if _, err := check(keyring, bytes.NewReader(canonicalText(data)), bytes.NewReader(sig.Bytes()), nil); err != nil {
+					t.Errorf("armor %v: checking the signature: %s", armored, err)
+				}
+
+				if _, err := check(keyring, bytes.NewReader(append(data, '.')), bytes.NewReader(sig.Bytes()), nil); err == nil {
+					t.Errorf("armor %v: the signature of other data is valid", armored)
+				}
+
+				sigType := signatureType(t, sig.Bytes(), armored)
+				if sigType != packet.SigTypeText {
+					t.Errorf("armor %v: signature type %d, want %d", armored, sigType, packet.SigTypeText)
+				}
+			}
+		})
+
+		t.Run(name+" clearsign", func(t *testing.T) {
+			var out bytes.Buffer
+
+			if err := gpgSignData(&out, entity, data, gpgSignMode{mode: gpgModeClearsign, armor: true, text: true}); err != nil {
+				t.Fatal(err)
+			}
+
+			b, rest := clearsign.Decode(out.Bytes())
+			if b == nil {
+				t.Fatalf("clearsign.Decode() found no signed message in %s", out.Bytes())
+			}
+
+			if len(bytes.TrimSpace(rest)) != 0 {
+				t.Errorf("data after the signed message: %q", rest)
+			}
+
+			want := "first line\nsecond line with trailing space\n-dash\n"
+			if string(b.Plaintext) != want {
+				t.Errorf("plaintext = %q, want %q", b.Plaintext, want)
+			}
+
+			if _, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(b.Bytes), b.ArmoredSignature.Body, nil); err != nil {
+				t.Errorf("checking the signature: %s", err)
+			}
+		})
+
+		for _, mode := range []gpgSignMode{
+			{mode: gpgModeSign, armor: true},
+			{mode: gpgModeSign},
+			{mode: gpgModeSign, armor: true, text: true},
+		} {
+			t.Run(name+" "+mode.String(), func(t *testing.T) {
+				var out bytes.Buffer
+
+				if err := gpgSignData(&out, entity, data, mode); err != nil {
+					t.Fatal(err)
+				}
+
+				r := bytes.NewReader(out.Bytes())
+
+				var msg *openpgp.MessageDetails
+
+				if mode.armor {
+					block, err := armor.Decode(r)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					if block.Type != "PGP MESSAGE" {
+						t.Errorf("armor type = %s, want PGP MESSAGE", block.Type)
+					}
+
+					msg, err = openpgp.ReadMessage(block.Body, keyring, nil, nil)
+					if err != nil {
+						t.Fatal(err)
+					}
+				} else {
+					var err error
+
+					msg, err = openpgp.ReadMessage(r, keyring, nil, nil)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				body, err := ioutil.ReadAll(msg.UnverifiedBody)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				want := data
+				if mode.text {
+					want = canonicalText(data)
+				}
+
+				if !bytes.Equal(body, want) {
+					t.Errorf("body = %q, want %q", body, want)
+				}
+
+				if !msg.IsSigned || msg.SignedBy == nil || msg.SignatureError != nil {
+					t.Errorf("signed %v by %v, error %v", msg.IsSigned, msg.SignedBy, msg.SignatureError)
+				}
+
+				if msg.LiteralData.IsBinary == mode.text {
+					t.Errorf("literal data binary = %v in text mode %v", msg.LiteralData.IsBinary, mode.text)
+				}
+			})
+		}
+	}
+}
+
+// signatureType returns the type of the signature packet sig.
+func signatureType(t *testing.T, sig []byte, armored bool) packet.SignatureType {
+	t.Helper()
+
+	r := bytes.NewReader(sig)
+
+	var p packet.Packet
+
+	if armored {
+		block, err := armor.Decode(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p, err = packet.Read(block.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		var err error
+
+		p, err = packet.Read(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ps, ok := p.(*packet.Signature)
+	if !ok {
+		t.Fatalf("packet = %T, want a signature", p)
+	}
+
+	return ps.SigType
+}
+
+func TestPrehashSign(t *testing.T) {
+	s := newTestAgent(t, "")
+
+	key, _ := testEd25519Key(t, 1)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("tree " + testTree + "\nauthor " + testAlice + "\ncommitter " + testAlice + "\n\nsubject\n")
+	created := time.Unix(1700000000, 0)
+
+	for _, k := range []struct {
+		name       string
+		privateKey interface{}
+	}{
+		{"ed25519", key},
+		{"ecdsa", ecKey},
+	} {
+		entity, err := s.SSHPrivateKeyToPGP(k.privateKey, gpgKeyOptions{uids: []string{"alice <alice@example.com>"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keyring := openpgp.EntityList{entity}
+
+		for _, tt := range []struct {
+			name string
+			mode gpgSignMode
+		}{
+			{"sha256", gpgSignMode{mode: gpgModeDetach, prehash: crypto.SHA256}},
+			{"sha512 armored", gpgSignMode{mode: gpgModeDetach, armor: true, prehash: crypto.SHA512}},
+			{"sha384 text", gpgSignMode{mode: gpgModeDetach, text: true, prehash: crypto.SHA384}},
+			{"sha224 created", gpgSignMode{mode: gpgModeDetach, prehash: crypto.SHA224, created: created}},
+		} {
+			// too short for the curve, see TestPrehashSignCurveHash
+			if k.name == "ecdsa" && tt.mode.prehash == crypto.SHA224 {
+				continue
+			}
+
+			t.Run(k.name+" "+tt.name, func(t *testing.T) {
+				hashed := data
+				if tt.mode.text {
+					hashed = canonicalText(data)
+				}
+
+				var sig bytes.Buffer
+
+				if err := gpgSignData(&sig, entity, testHashState(t, tt.mode.prehash, hashed), tt.mode); err != nil {
+					t.Fatal(err)
+				}
+
+				raw := sig.Bytes()
+
+				if tt.mode.armor {
+					block, err := armor.Decode(bytes.NewReader(raw))
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					if block.Type != openpgp.SignatureType {
+						t.Errorf("armor type = %s, want %s", block.Type, openpgp.SignatureType)
+					}
+
+					if _, err := openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(data), bytes.NewReader(raw), nil); err != nil {
+						t.Errorf("CheckArmoredDetachedSignature() error = %v", err)
+					}
+
+					return
+				}
+
+				if _, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(data), bytes.NewReader(raw), nil); err != nil {
+					t.Errorf("CheckDetachedSignature() error = %v", err)
+				}
+
+				if _, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(append(data, '.')), bytes.NewReader(raw), nil); err == nil {
+					t.Error("CheckDetachedSignature() accepted other data")
+				}
+
+				p, err := packet.Read(bytes.NewReader(raw))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				ps, ok := p.(*packet.Signature)
+				if !ok {
+					t.Fatalf("packet = %T, want a signature", p)
+				}
+
+				sigType := packet.SigTypeBinary
+				if tt.mode.text {
+					sigType = packet.SigTypeText
+				}
+
+				if ps.Hash != tt.mode.prehash || ps.SigType != sigType {
+					t.Errorf("signature hash %s type %d, want %s type %d", hashName(ps.Hash), ps.SigType, hashName(tt.mode.prehash), sigType)
+				}
+
+				if !tt.mode.created.IsZero() && !ps.CreationTime.Equal(tt.mode.created) {
+					t.Errorf("signature created %s, want %s", ps.CreationTime, tt.mode.created)
+				}
+			})
+		}
+	}
+}
+
+func TestPrehashSignCurveHash(t *testing.T) {
+	s := newTestAgent(t, "")
+
+	data := []byte("data")
+
+	for _, tt := range []struct {
+		curve elliptic.Curve
+		min   crypto.Hash
+	}{
+		{elliptic.P256(), crypto.SHA256},
+		{elliptic.P384(), crypto.SHA384},
+		{elliptic.P521(), crypto.SHA512},
+	} {
+		key, err := ecdsa.GenerateKey(tt.curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entity, err := s.SSHPrivateKeyToPGP(key, gpgKeyOptions{uids: []string{"alice <alice@example.com>"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, h := range []crypto.Hash{crypto.SHA224, crypto.SHA256, crypto.SHA384, crypto.SHA512} {
+			var sig bytes.Buffer
+
+			err := gpgSignData(&sig, entity, testHashState(t, h, data), gpgSignMode{mode: gpgModeDetach, prehash: h})
+
+			if h.Size() < tt.min.Size() {
+				if !errors.Is(err, errBadRequest) {
+					t.Errorf("%s with %s: error = %v, want %v", tt.curve.Params().Name, hashName(h), err, errBadRequest)
+				}
+
+				continue
+			}
+
+			if err != nil {
+				t.Errorf("%s with %s: %s", tt.curve.Params().Name, hashName(h), err)
+				continue
+			}
+
+			if _, err := openpgp.CheckDetachedSignature(openpgp.EntityList{entity}, bytes.NewReader(data), &sig, nil); err != nil {
+				t.Errorf("%s with %s: checking the signature: %s", tt.curve.Params().Name, hashName(h), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// gpgSignV2 is the version of the SSH wire encoded ssh-gpg-sign@42wim
+// request. Legacy requests start with the NUL padded uid instead, which can't
+// start with this version.
+const gpgSignV2 = 2
+
+// gpgLegacyHeader is the size of the NUL padded uid of a legacy request.
+const gpgLegacyHeader = 400
+
+// Status of a ssh-gpg-sign@42wim v2 reply.
+const (
+	gpgStatusOK         = "ok"
+	gpgStatusNoSigner   = "no_signer"
+	gpgStatusAmbiguous  = "ambiguous_signer"
+	gpgStatusLocked     = "locked"
+	gpgStatusDenied     = "denied"
+	gpgStatusBadRequest = "bad_request"
+	gpgStatusFailed     = "failed"
+)
+
+var errBadRequest = errors.New("agent: bad request")
+
+// gpgSignOptions are the options a v2 request may have.
+var gpgSignOptions = map[string]bool{
+	"mode":     true,
+	"armor":    true,
+	"textmode": true,
+	"hash":     true,
+	"created":  true,
+}
+
+// gpgSignRequestV2 is a ssh-gpg-sign@42wim v2 request, the options are a
+// list of name and value string pairs.
+type gpgSignRequestV2 struct {
+	Version uint32
+	Signer  string
+	Options []byte
+	Data    []byte
+}
+
+type gpgSignOption struct {
+	Name  string
+	Value string
+	Rest  []byte `ssh:"rest"`
+}
+
+// gpgSignReplyV2 is the reply to a v2 request. Errors are sent as a reply
+// too, a failed extension doesn't tell the client what went wrong.
+type gpgSignReplyV2 struct {
+	Status    string
+	Message   string
+	Signature []byte
+}
+
+// gpgSignRequest is a parsed ssh-gpg-sign@42wim request.
+type gpgSignRequest struct {
+	signer  string
+	options map[string]string
+	mode    gpgSignMode
+	data    []byte
+}
+
+func isGPGSignV2(contents []byte) bool {
+	return len(contents) >= 4 && binary.BigEndian.Uint32(contents) == gpgSignV2
+}
+
+// parseGPGSignRequest parses a v2 or a legacy ssh-gpg-sign@42wim request.
+func parseGPGSignRequest(contents []byte) (*gpgSignRequest, error) {
+	if !isGPGSignV2(contents) {
+		return parseGPGSignLegacy(contents)
+	}
+
+	var msg gpgSignRequestV2
+	if err := ssh.Unmarshal(contents, &msg); err != nil {
+		return nil, fmt.Errorf("%w: %s", errBadRequest, err)
+	}
+
+	if msg.Signer == "" {
+		return nil, fmt.Errorf("%w: no signer", errBadRequest)
+	}
+
+	req := &gpgSignRequest{
+		signer:  msg.Signer,
+		options: make(map[string]string),
+		data:    msg.Data,
+	}
+
+	for rest := msg.Options; len(rest) > 0; {
+		var opt gpgSignOption
+		if err := ssh.Unmarshal(rest, &opt); err != nil {
+			return nil, fmt.Errorf("%w: options: %s", errBadRequest, err)
+		}
+
+		if !gpgSignOptions[opt.Name] {
+			return nil, fmt.Errorf("%w: unknown option %s", errBadRequest, opt.Name)
+		}
+
+		if _, ok := req.options[opt.Name]; ok {
+			return nil, fmt.Errorf("%w: duplicate option %s", errBadRequest, opt.Name)
+		}
+
+		req.options[opt.Name] = opt.Value
+		rest = opt.Rest
+	}
+
+	var err error
+
+	if req.mode, err = parseGPGSignMode(req.options); err != nil {
+		return nil, err
+	}
+
+	if req.mode.prehash != 0 {
+		if _, err := hashState(req.mode.prehash, req.data); err != nil {
+			return nil, err
+		}
+	}
+
+	return req, nil
+}
+
+// parseGPGSignLegacy parses a request of a 400 bytes NUL padded uid followed
+// by the data.
+func parseGPGSignLegacy(contents []byte) (*gpgSignRequest, error) {
+	if len(contents) < gpgLegacyHeader {
+		return nil, fmt.Errorf("%w: %d bytes is too short", errBadRequest, len(contents))
+	}
+
+	uidlen := bytes.IndexByte(contents[:gpgLegacyHeader], 0)
+	if uidlen < 0 {
+		return nil, fmt.Errorf("%w: uid isn't NUL terminated", errBadRequest)
+	}
+
+	if uidlen == 0 {
+		return nil, fmt.Errorf("%w: no signer", errBadRequest)
+	}
+
+	return &gpgSignRequest{
+		signer: string(contents[:uidlen]),
+		mode:   defaultGPGSignMode,
+		data:   contents[gpgLegacyHeader:],
+	}, nil
+}
+
+// gpgSignReply encodes the result of a v2 request.
+func gpgSignReply(sig []byte, err error) []byte {
+	reply := gpgSignReplyV2{
+		Status:    gpgStatusOK,
+		Signature: sig,
+	}
+
+	if err != nil {
+		reply.Status = gpgReplyStatus(err)
+		reply.Message = err.Error()
+		reply.Signature = nil
+	}
+
+	return ssh.Marshal(reply)
+}
+
+func gpgReplyStatus(err error) string {
+	switch {
+	case errors.Is(err, errNoSigner):
+		return gpgStatusNoSigner
+	case errors.Is(err, errAmbiguousSigner):
+		return gpgStatusAmbiguous
+	case errors.Is(err, errLocked):
+		return gpgStatusLocked
+	case errors.Is(err, errBadRequest):
+		return gpgStatusBadRequest
+	case errors.Is(err, errPolicyDenied), errors.Is(err, errNotConfirmed),
+		errors.Is(err, errApprovalDenied), errors.Is(err, errApprovalTimeout),
+		errors.Is(err, errNotPermitted), errors.Is(err, errRateLimited),
+		errors.Is(err, errQuotaExceeded), errors.Is(err, errNotGitObject),
+		errors.Is(err, errIdentityMismatch):
+		return gpgStatusDenied
+	default:
+		return gpgStatusFailed
+	}
+}
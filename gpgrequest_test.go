@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"encoding"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testGPGSignLegacy returns a legacy request of signer and data.
+func testGPGSignLegacy(signer string, data []byte) []byte {
+	header := make([]byte, gpgLegacyHeader)
+	copy(header, signer)
+
+	return append(header, data...)
+}
+
+// testGPGSignV2 returns a v2 request of signer and data with the options as
+// name and value pairs.
+func testGPGSignV2(signer string, data []byte, options ...string) []byte {
+	var opts []byte
+
+	for i := 0; i+1 < len(options); i += 2 {
+		opts = append(opts, ssh.Marshal(struct {
+			Name  string
+			Value string
+		}{options[i], options[i+1]})...)
+	}
+
+	return ssh.Marshal(gpgSignRequestV2{
+		Version: gpgSignV2,
+		Signer:  signer,
+		Options: opts,
+		Data:    data,
+	})
+}
+
+// testHashState returns the state of h after hashing data, like a client
+// sending a pre-hashed request does.
+func testHashState(t *testing.T, h crypto.Hash, data []byte) []byte {
+	t.Helper()
+
+	hh := h.New()
+	hh.Write(data)
+
+	state, err := hh.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return state
+}
+
+func TestParseGPGSignRequest(t *testing.T) {
+	data := testObject("tree "+testTree, "author "+testAlice, "committer "+testAlice)
+	state := testHashState(t, crypto.SHA256, data)
+
+	tests := []struct {
+		name     string
+		contents []byte
+		signer   string
+		data     []byte
+		mode     gpgSignMode
+	}{
+		{
+			name:     "legacy",
+			contents: testGPGSignLegacy("alice <alice@example.com>", data),
+			signer:   "alice <alice@example.com>",
+			data:     data,
+			mode:     defaultGPGSignMode,
+		},
+		{
+			name:     "legacy without data",
+			contents: testGPGSignLegacy("14CB79F70CD3C13D", nil),
+			signer:   "14CB79F70CD3C13D",
+			data:     []byte{},
+			mode:     defaultGPGSignMode,
+		},
+		{
+			name:     "legacy uid of 399 bytes",
+			contents: testGPGSignLegacy(strings.Repeat("a", gpgLegacyHeader-1), data),
+			signer:   strings.Repeat("a", gpgLegacyHeader-1),
+			data:     data,
+			mode:     defaultGPGSignMode,
+		},
+		{
+			name:     "v2",
+			contents: testGPGSignV2("alice <alice@example.com>", data),
+			signer:   "alice <alice@example.com>",
+			data:     data,
+			mode:     defaultGPGSignMode,
+		},
+		{
+			name:     "v2 binary detached text",
+			contents: testGPGSignV2("@example.com", data, "armor", "no", "textmode", "yes"),
+			signer:   "@example.com",
+			data:     data,
+			mode:     gpgSignMode{mode: gpgModeDetach, text: true},
+		},
+		{
+			name:     "v2 clearsign",
+			contents: testGPGSignV2("alice", data, "mode", "clearsign", "armor", "no"),
+			signer:   "alice",
+			data:     data,
+			mode:     gpgSignMode{mode: gpgModeClearsign, armor: true, text: true},
+		},
+		{
+			name:     "v2 sign",
+			contents: testGPGSignV2("alice", data, "mode", "sign"),
+			signer:   "alice",
+			data:     data,
+			mode:     gpgSignMode{mode: gpgModeSign, armor: true},
+		},
+		{
+			name:     "v2 pre-hashed",
+			contents: testGPGSignV2("alice", state, "hash", "sha256", "created", "1700000000"),
+			signer:   "alice",
+			data:     state,
+			mode:     gpgSignMode{mode: gpgModeDetach, armor: true, prehash: crypto.SHA256, created: time.Unix(1700000000, 0)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := parseGPGSignRequest(tt.contents)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if req.signer != tt.signer || !bytes.Equal(req.data, tt.data) || req.mode != tt.mode {
+				t.Errorf("parseGPGSignRequest() = %q %q %+v, want %q %q %+v", req.signer, req.data, req.mode, tt.signer, tt.data, tt.mode)
+			}
+		})
+	}
+}
+
+func TestParseGPGSignRequestInvalid(t *testing.T) {
+	data := []byte("data")
+
+	tests := []struct {
+		name     string
+		contents []byte
+	}{
+		{"legacy too short", testGPGSignLegacy("alice", nil)[:gpgLegacyHeader-1]},
+		{"legacy without signer", testGPGSignLegacy("", data)},
+		{"legacy not NUL terminated", testGPGSignLegacy(strings.Repeat("a", gpgLegacyHeader), data)},
+		{"v2 truncated", testGPGSignV2("alice", data)[:12]},
+		{"v2 without signer", testGPGSignV2("", data)},
+		{"v2 unknown option", testGPGSignV2("alice", data, "compress", "yes")},
+		{"v2 duplicate option", testGPGSignV2("alice", data, "armor", "yes", "armor", "no")},
+		{"v2 unknown mode", testGPGSignV2("alice", data, "mode", "encrypt")},
+		{"v2 invalid armor", testGPGSignV2("alice", data, "armor", "true")},
+		{"v2 unsupported hash", testGPGSignV2("alice", data, "hash", "sha1")},
+		{"v2 pre-hashed clearsign", testGPGSignV2("alice", data, "mode", "clearsign", "hash", "sha256")},
+		{"v2 created without hash", testGPGSignV2("alice", data, "created", "1700000000")},
+		{"v2 invalid created", testGPGSignV2("alice", testHashState(t, crypto.SHA256, data), "hash", "sha256", "created", "0")},
+		{"v2 invalid hash state", testGPGSignV2("alice", data, "hash", "sha256")},
+	}
+
+	for _, tt := range tests {
+		if _, err := parseGPGSignRequest(tt.contents); !errors.Is(err, errBadRequest) {
+			t.Errorf("%s: parseGPGSignRequest() error = %v, want %v", tt.name, err, errBadRequest)
+		}
+	}
+}
+
+func TestGPGSignReply(t *testing.T) {
+	tests := []struct {
+		sig    []byte
+		err    error
+		status string
+	}{
+		{[]byte("signature"), nil, gpgStatusOK},
+		{nil, errNoSigner, gpgStatusNoSigner},
+		{nil, errLocked, gpgStatusLocked},
+		{nil, fmt.Errorf("%w: no signer", errBadRequest), gpgStatusBadRequest},
+		{nil, errPolicyDenied, gpgStatusDenied},
+		{nil, errNotPermitted, gpgStatusDenied},
+		{nil, errRateLimited, gpgStatusDenied},
+		{nil, errIdentityMismatch, gpgStatusDenied},
+		{nil, fmt.Errorf("%w: @home matches a, b", errAmbiguousSigner), gpgStatusAmbiguous},
+		{[]byte("partial"), errors.New("pinentry failed"), gpgStatusFailed},
+	}
+
+	for _, tt := range tests {
+		var reply gpgSignReplyV2
+		if err := ssh.Unmarshal(gpgSignReply(tt.sig, tt.err), &reply); err != nil {
+			t.Fatal(err)
+		}
+
+		if reply.Status != tt.status {
+			t.Errorf("gpgSignReply(%v) status = %s, want %s", tt.err, reply.Status, tt.status)
+		}
+
+		if tt.err == nil && (reply.Message != "" || !bytes.Equal(reply.Signature, tt.sig)) {
+			t.Errorf("gpgSignReply() = %+v, want signature %q", reply, tt.sig)
+		}
+
+		if tt.err != nil && (reply.Message != tt.err.Error() || len(reply.Signature) != 0) {
+			t.Errorf("gpgSignReply(%v) = %+v, want message %q and no signature", tt.err, reply, tt.err)
+		}
+	}
+}
+
+func TestExtensionGPGSignV2(t *testing.T) {
+	s := newTestAgent(t, "")
+
+	res, err := s.Extension(gpgSignExtension, testGPGSignV2("nobody <nobody@example.com>", []byte("data")))
+	if err != nil {
+		t.Fatalf("Extension() of a v2 request error = %v, want the error in the reply", err)
+	}
+
+	var reply gpgSignReplyV2
+	if err := ssh.Unmarshal(res, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply.Status != gpgStatusNoSigner {
+		t.Errorf("reply status = %s, want %s", reply.Status, gpgStatusNoSigner)
+	}
+
+	if _, err := s.Extension(gpgSignExtension, testGPGSignLegacy("nobody <nobody@example.com>", []byte("data"))); !errors.Is(err, errNoSigner) {
+		t.Errorf("Extension() of a legacy request error = %v, want %v", err, errNoSigner)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Kinds of matches of a gpg key specifier, from the least to the most
+// specific. Only the signers matching on the most specific kind are
+// candidates.
+const (
+	gpgSpecNone = iota
+	gpgSpecSubstring
+	gpgSpecEmail
+	gpgSpecUID
+	gpgSpecShortKeyID
+	gpgSpecLongKeyID
+	gpgSpecFingerprint
+)
+
+var errAmbiguousSigner = errors.New("ambiguous signer")
+
+// gpgSpec is a parsed key specifier as given to gpg -u.
+type gpgSpec struct {
+	keyid   string // uppercase hex key id or fingerprint
+	uid     string // exact uid
+	email   string // lowercase email between < and >
+	part    string // lowercase part of the uid, or of the email after @
+	inEmail bool
+}
+
+// parseGPGSpec parses the key specifier spec like gpg does: a short or long
+// key id or a fingerprint in hex with an optional 0x prefix, =uid for an
+// exact uid, <email> for an exact email, @text for a part of the email or
+// else a part of the uid.
+func parseGPGSpec(spec string) gpgSpec {
+	spec = strings.TrimSpace(spec)
+
+	hex := strings.TrimSuffix(spec, "!")
+	if strings.HasPrefix(hex, "0x") || strings.HasPrefix(hex, "0X") {
+		hex = hex[2:]
+	}
+
+	// fingerprints are often written in groups of 4
+	if fp := strings.ReplaceAll(hex, " ", ""); len(fp) == 40 {
+		hex = fp
+	}
+
+	if isHex(hex) && (len(hex) == 8 || len(hex) == 16 || len(hex) == 40) {
+		return gpgSpec{keyid: strings.ToUpper(hex)}
+	}
+
+	switch {
+	case strings.HasPrefix(spec, "="):
+		return gpgSpec{uid: spec[1:]}
+	case strings.HasPrefix(spec, "<") && strings.HasSuffix(spec, ">"):
+		return gpgSpec{email: strings.ToLower(spec[1 : len(spec)-1])}
+	case strings.HasPrefix(spec, "@"):
+		return gpgSpec{part: strings.ToLower(spec[1:]), inEmail: true}
+	default:
+		return gpgSpec{uid: spec, part: strings.ToLower(spec)}
+	}
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') && (c < 'A' || c > 'F') {
+			return false
+		}
+	}
+
+	return s != ""
+}
+
+// match returns how the key with fingerprint fp and uids matches the
+// specifier and the matching uid. When several uids match the first one wins,
+// so a key id or fingerprint gives the primary uid.
+func (spec gpgSpec) match(fp string, uids []string) (int, string) {
+	if spec.keyid != "" {
+		switch {
+		case len(uids) == 0:
+		case spec.keyid == fp:
+			return gpgSpecFingerprint, uids[0]
+		case len(spec.keyid) == 16 && strings.HasSuffix(fp, spec.keyid):
+			return gpgSpecLongKeyID, uids[0]
+		case len(spec.keyid) == 8 && strings.HasSuffix(fp, spec.keyid):
+			return gpgSpecShortKeyID, uids[0]
+		}
+
+		return gpgSpecNone, ""
+	}
+
+	best, match := gpgSpecNone, ""
+
+	for _, uid := range uids {
+		kind := gpgSpecNone
+		email := strings.ToLower(uidEmail(uid))
+
+		switch {
+		case spec.uid != "" && uid == spec.uid:
+			kind = gpgSpecUID
+		case spec.email != "" && email == spec.email:
+			kind = gpgSpecEmail
+		case spec.part == "":
+		case spec.inEmail && strings.Contains(email, spec.part),
+			!spec.inEmail && strings.Contains(strings.ToLower(uid), spec.part):
+			kind = gpgSpecSubstring
+		}
+
+		if kind > best {
+			best, match = kind, uid
+		}
+	}
+
+	return best, match
+}
+
+// uidEmail returns the email of a "Name <email>" uid.
+func uidEmail(uid string) string {
+	if _, email, ok := splitGitIdent(uid); ok {
+		return email
+	}
+
+	return ""
+}
+
+// gpgCandidate is a GPG key matching a key specifier, lk is set instead of
+// key when the key file it is derived from isn't loaded yet.
+type gpgCandidate struct {
+	key *GPGKey
+	lk  *lazyKey
+	fp  string
+	uid string
+}
+
+// resolveGPGKey returns the GPG key, or the key file it would be derived from,
+// and the uid matching the key specifier spec. A specifier matching several
+// keys is refused, unless one of them matches more specifically, eg on the
+// full uid instead of a part of it.
+func (s *SSHAgent) resolveGPGKey(spec string) (gpgCandidate, error) {
+	var (
+		candidates []gpgCandidate
+		lazykeys   []*lazyKey
+		best       = gpgSpecNone
+	)
+
+	add := func(kind int, c gpgCandidate) {
+		if kind == gpgSpecNone || kind < best {
+			return
+		}
+
+		if kind > best {
+			best, candidates = kind, nil
+		}
+
+		candidates = append(candidates, c)
+	}
+
+	ks := parseGPGSpec(spec)
+
+	s.keysMutex.RLock()
+	for i := range s.gpgkeys {
+		k := &s.gpgkeys[i]
+		fp := fmt.Sprintf("%X", k.signer.PrimaryKey.Fingerprint)
+		kind, uid := ks.match(fp, k.uids)
+		add(kind, gpgCandidate{key: k, fp: fp, uid: uid})
+	}
+
+	seen := make(map[string]bool)
+
+	for _, lk := range s.lazykeys {
+		blob := string(lk.pk.Marshal())
+		if _, ok := s.keys[blob]; ok || seen[blob] {
+			continue
+		}
+
+		seen[blob] = true
+		lazykeys = append(lazykeys, lk)
+	}
+	s.keysMutex.RUnlock()
+
+	for _, lk := range lazykeys {
+		fp, uids := s.lazyGPGKey(lk)
+		kind, uid := ks.match(fp, uids)
+		add(kind, gpgCandidate{lk: lk, fp: fp, uid: uid})
+	}
+
+	switch len(candidates) {
+	case 0:
+		return gpgCandidate{}, nil
+	case 1:
+		return candidates[0], nil
+	}
+
+	var matches []string
+
+	for _, c := range candidates {
+		matches = append(matches, fmt.Sprintf("%s (%s)", c.fp, c.uid))
+	}
+
+	sort.Strings(matches)
+
+	return gpgCandidate{}, fmt.Errorf("%w: %s matches %s", errAmbiguousSigner, spec, strings.Join(matches, ", "))
+}
+
+// lazyGPGKey returns the fingerprint and the uids of the GPG key that would be
+// derived from the key file lk.
+func (s *SSHAgent) lazyGPGKey(lk *lazyKey) (string, []string) {
+	sections := s.gpgMatchingSections(newGPGMatchKey(lk.pk, lk.comment))
+	if len(sections) == 0 {
+		return "", nil
+	}
+
+	opts, err := s.gpgKeyOptions(sections)
+	if err != nil {
+		return "", nil
+	}
+
+	fp, err := gpgFingerprint(lk.pk)
+	if err != nil {
+		return "", nil
+	}
+
+	return fp, opts.uids
+}
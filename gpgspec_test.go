@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestParseGPGSpec(t *testing.T) {
+	tests := []struct {
+		spec string
+		want gpgSpec
+	}{
+		{"14CB79F70CD3C13D", gpgSpec{keyid: "14CB79F70CD3C13D"}},
+		{"0x14cb79f70cd3c13d", gpgSpec{keyid: "14CB79F70CD3C13D"}},
+		{"0CD3C13D", gpgSpec{keyid: "0CD3C13D"}},
+		{"0CD3C13D!", gpgSpec{keyid: "0CD3C13D"}},
+		{"9BE9DB4E9EE74FA2AD4CF0DBC8B62E26A7113E29", gpgSpec{keyid: "9BE9DB4E9EE74FA2AD4CF0DBC8B62E26A7113E29"}},
+		{"9be9 db4e 9ee7 4fa2 ad4c f0db c8b6 2e26 a711 3e29", gpgSpec{keyid: "9BE9DB4E9EE74FA2AD4CF0DBC8B62E26A7113E29"}},
+		{"0CD3C13", gpgSpec{uid: "0CD3C13", part: "0cd3c13"}},
+		{"=Alice <alice@work>", gpgSpec{uid: "Alice <alice@work>"}},
+		{"<Alice@Work>", gpgSpec{email: "alice@work"}},
+		{"@Work", gpgSpec{part: "work", inEmail: true}},
+		{"Alice <alice@work>", gpgSpec{uid: "Alice <alice@work>", part: "alice <alice@work>"}},
+		{" alice ", gpgSpec{uid: "alice", part: "alice"}},
+		{"deadbeef", gpgSpec{keyid: "DEADBEEF"}},
+	}
+
+	for _, tt := range tests {
+		if got := parseGPGSpec(tt.spec); got != tt.want {
+			t.Errorf("parseGPGSpec(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+const testGPGSpecConfig = `
+[gpg.alice]
+name="Alice"
+email="alice@work"
+matchcomment="alice"
+[gpg.bob]
+name="Bob"
+email="bob@work"
+uids=["Malice <alice@work>", "Old Carol <carol@home>"]
+matchcomment="bob"
+[gpg.carol]
+name="Carol"
+email="carol@home"
+matchcomment="carol"
+[gpg.dave]
+name="Dave"
+email="dave@home"
+matchcomment="dave"
+`
+
+// newTestGPGSpecAgent returns an agent with the keys of alice and bob loaded
+// and the key files of carol and dave in dir.
+func newTestGPGSpecAgent(t *testing.T) *SSHAgent {
+	t.Helper()
+
+	s := newTestAgent(t, testGPGSpecConfig)
+	dir := t.TempDir()
+
+	for i, name := range []string{"alice", "bob", "carol", "dave"} {
+		key, pk := testEd25519Key(t, byte(i+1))
+
+		if name == "alice" || name == "bob" {
+			if err := s.Add(agent.AddedKey{PrivateKey: key, Comment: name}); err != nil {
+				t.Fatal(err)
+			}
+
+			continue
+		}
+
+		block, err := ssh.MarshalPrivateKey(*key, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		s.lazykeys = append(s.lazykeys, &lazyKey{name: "keys." + name, path: path, comment: name, pk: pk})
+	}
+
+	return s
+}
+
+func TestResolveGPGKey(t *testing.T) {
+	s := newTestGPGSpecAgent(t)
+
+	fp := func(seed byte) string {
+		_, pk := testEd25519Key(t, seed)
+
+		fp, err := gpgFingerprint(pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return fp
+	}
+
+	tests := []struct {
+		spec      string
+		uid       string
+		lazy      bool
+		ambiguous bool
+	}{
+		{spec: fp(1), uid: "Alice <alice@work>"},
+		{spec: "0x" + fp(2)[24:], uid: "Bob <bob@work>"},
+		{spec: fp(2)[32:], uid: "Bob <bob@work>"},
+		{spec: fp(3), uid: "Carol <carol@home>", lazy: true},
+		// the full uid matches more specifically than the email or a part of
+		// the uid of bob
+		{spec: "Alice <alice@work>", uid: "Alice <alice@work>"},
+		{spec: "=Malice <alice@work>", uid: "Malice <alice@work>"},
+		{spec: "<alice@work>", ambiguous: true},
+		{spec: "<bob@work>", uid: "Bob <bob@work>"},
+		{spec: "bob@", uid: "Bob <bob@work>"},
+		{spec: "alice", ambiguous: true},
+		{spec: "@work", ambiguous: true},
+		// the uid of the key file matches more specifically than a uid of a
+		// loaded key with the same email
+		{spec: "Carol <carol@home>", uid: "Carol <carol@home>", lazy: true},
+		{spec: "carol", ambiguous: true},
+		{spec: "<dave@home>", uid: "Dave <dave@home>", lazy: true},
+		{spec: "@home", ambiguous: true},
+		{spec: "eve"},
+		{spec: "DEADBEEF"},
+	}
+
+	for _, tt := range tests {
+		c, err := s.resolveGPGKey(tt.spec)
+
+		if tt.ambiguous {
+			if !errors.Is(err, errAmbiguousSigner) {
+				t.Errorf("resolveGPGKey(%q) error = %v, want %v", tt.spec, err, errAmbiguousSigner)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("resolveGPGKey(%q) error = %v", tt.spec, err)
+			continue
+		}
+
+		if c.uid != tt.uid || (c.lk != nil) != tt.lazy || (c.key == nil) != (tt.uid == "" || tt.lazy) {
+			t.Errorf("resolveGPGKey(%q) = %q lazy %v, want %q lazy %v", tt.spec, c.uid, c.lk != nil, tt.uid, tt.lazy)
+		}
+	}
+}
+
+func TestFindGPGSignerLoadsOneKeyFile(t *testing.T) {
+	s := newTestGPGSpecAgent(t)
+
+	carol, dave := s.lazykeys[0], s.lazykeys[1]
+
+	if _, _, err := s.findGPGSigner(nil, "@home"); !errors.Is(err, errAmbiguousSigner) {
+		t.Fatalf("findGPGSigner() error = %v, want %v", err, errAmbiguousSigner)
+	}
+
+	if s.findLazyKey(carol.pk) == nil || s.findLazyKey(dave.pk) == nil {
+		t.Fatal("findGPGSigner() loaded a key file for an ambiguous specifier")
+	}
+
+	signer, uid, err := s.findGPGSigner(nil, "Carol <carol@home>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uid != "Carol <carol@home>" || !bytes.Equal(signer.pk.Marshal(), carol.pk.Marshal()) {
+		t.Errorf("findGPGSigner() = %s, want Carol <carol@home>", uid)
+	}
+
+	if s.findLazyKey(carol.pk) != nil || s.findLazyKey(dave.pk) == nil {
+		t.Error("findGPGSigner() didn't load only the key file of carol")
+	}
+
+	// carol is loaded now, so @home matches her loaded key and the key file
+	// of dave equally
+	if _, _, err := s.findGPGSigner(nil, "@home"); !errors.Is(err, errAmbiguousSigner) {
+		t.Errorf("findGPGSigner() error = %v, want %v", err, errAmbiguousSigner)
+	}
+}
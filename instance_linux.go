@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// instanceDir returns the per-user directory for the socket of the single
+// instance mode.
+func instanceDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, agentName)
+	}
+
+	return filepath.Join(os.TempDir(), fmt.Sprintf("%s-%d", agentName, os.Getuid()))
+}
+
+// singleInstance returns true when the agent uses the single instance socket,
+// an agent started with -a or with a command to run gets its own socket.
+func (s *SSHAgent) singleInstance() bool {
+	return s.v.GetBool("singleinstance") && s.opts.bindAddress == "" && len(s.opts.command) == 0
+}
+
+// findInstance prints the environment of an ssh-agentx that is already running
+// on the single instance socket and returns true if there is one.
+func (s *SSHAgent) findInstance() bool {
+	if !s.singleInstance() || socketActivated() {
+		return false
+	}
+
+	socketFile := filepath.Join(instanceDir(), "agent.sock")
+
+	info, err := queryInstance(socketFile)
+	if err != nil {
+		return false
+	}
+
+	printEnv(os.Stdout, s.opts.shell, socketFile, info.Pid)
+
+	return true
+}
+
+// listenInstance listens on the single instance socket, replacing a socket left
+// behind by an agent that is no longer running.
+func (s *SSHAgent) listenInstance() (net.Listener, string) {
+	dir := instanceDir()
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		log.Fatalln("Failed to create socket directory:", err)
+	}
+
+	if err := checkInstanceDir(dir); err != nil {
+		log.Fatalln(err)
+	}
+
+	// serialize agents starting at the same time
+	lock, err := os.OpenFile(filepath.Join(dir, "agent.lock"), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		log.Fatalln("Failed to open lock file:", err)
+	}
+	defer lock.Close()
+
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		log.Fatalln("Failed to lock:", err)
+	}
+
+	socketFile := filepath.Join(dir, "agent.sock")
+
+	if fi, err := os.Lstat(socketFile); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			log.Fatalln(socketFile, "exists and is not a socket")
+		}
+
+		info, err := queryInstance(socketFile)
+
+		switch {
+		case err == nil:
+			printEnv(os.Stdout, s.opts.shell, socketFile, info.Pid)
+			os.Exit(0)
+		case errors.Is(err, syscall.ECONNREFUSED):
+			log.Println("removing stale socket", socketFile)
+		case errors.Is(err, agent.ErrExtensionUnsupported):
+			log.Fatalln("another agent that isn't ssh-agentx is listening on", socketFile)
+		default:
+			log.Fatalln("Failed to check running agent on", socketFile+":", err)
+		}
+
+		if err := os.Remove(socketFile); err != nil {
+			log.Fatalln("Failed to remove stale socket:", err)
+		}
+	}
+
+	l, err := net.Listen("unix", socketFile)
+	if err != nil {
+		log.Fatalln("Failed to listen on UNIX socket:", err)
+	}
+
+	return l, socketFile
+}
+
+// checkInstanceDir makes sure nobody else can access the socket directory.
+func checkInstanceDir(dir string) error {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.IsDir() || !ok || int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is not a directory owned by you", dir)
+	}
+
+	if fi.Mode().Perm()&0o077 != 0 {
+		return fmt.Errorf("%s is accessible by other users (mode %s)", dir, fi.Mode().Perm())
+	}
+
+	return nil
+}
+
+// queryInstance asks the agent on socketFile for its information.
+func queryInstance(socketFile string) (*agentInfo, error) {
+	conn, err := net.DialTimeout("unix", socketFile, 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	res, err := agent.NewClient(conn).Extension(infoExtension, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var info agentInfo
+	if err := json.Unmarshal(res, &info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestSingleInstance(t *testing.T) {
+	tests := []struct {
+		cfg         string
+		bindAddress string
+		command     []string
+		want        bool
+	}{
+		{"singleinstance=true", "", nil, true},
+		{"", "", nil, false},
+		{"singleinstance=true", "/tmp/agent.sock", nil, false},
+		{"singleinstance=true", "", []string{"make"}, false},
+	}
+
+	for _, tt := range tests {
+		s := newTestAgent(t, tt.cfg)
+		s.opts.bindAddress, s.opts.command = tt.bindAddress, tt.command
+
+		if got := s.singleInstance(); got != tt.want {
+			t.Errorf("singleInstance() with %q -a %q %q = %v, want %v", tt.cfg, tt.bindAddress, tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestCheckInstanceDir(t *testing.T) {
+	dir := t.TempDir()
+
+	private := filepath.Join(dir, "private")
+	shared := filepath.Join(dir, "shared")
+	file := filepath.Join(dir, "file")
+
+	if err := os.Mkdir(private, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(shared, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chmod(shared, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkInstanceDir(private); err != nil {
+		t.Errorf("checkInstanceDir(private) error = %v", err)
+	}
+
+	for _, d := range []string{shared, file, filepath.Join(dir, "missing")} {
+		if err := checkInstanceDir(d); err == nil {
+			t.Errorf("checkInstanceDir(%s) succeeded", d)
+		}
+	}
+}
+
+func TestListenInstance(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+
+	s := newTestAgent(t, "singleinstance=true")
+
+	if err := os.MkdirAll(instanceDir(), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	// leave a stale socket behind
+	stale, err := net.Listen("unix", filepath.Join(instanceDir(), "agent.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, socketFile := s.listenInstance()
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			agent.ServeAgent(s.newConnAgent(nil), c)
+		}
+	}()
+
+	info, err := queryInstance(socketFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Pid != os.Getpid() {
+		t.Errorf("queryInstance() = %+v, want pid %d", info, os.Getpid())
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// lazyKey is a private key file declared in the [keys.*] config sections. Its
+// public key is listed right away, the private key is only decrypted when it
+// is needed for signing.
+type lazyKey struct {
+	name    string
+	path    string
+	comment string
+	pk      ssh.PublicKey
+	mutex   sync.Mutex
+}
+
+// loadKeyFiles reads the public keys of the [keys.*] config sections.
+func (s *SSHAgent) loadKeyFiles() {
+	var (
+		names    []string
+		lazykeys []*lazyKey
+	)
+
+	for _, k := range s.v.AllKeys() {
+		if !strings.HasPrefix(k, "keys.") {
+			continue
+		}
+
+		if !strings.HasSuffix(k, ".path") {
+			continue
+		}
+
+		names = append(names, strings.TrimSuffix(k, ".path"))
+	}
+
+	for _, name := range names {
+		path := expandHome(s.v.GetString(name + ".path"))
+
+		pk, comment, err := readPublicKey(path)
+		if err != nil {
+			log.Printf("%s: %s\n", name, err)
+			continue
+		}
+
+		if s.v.GetString(name+".comment") != "" {
+			comment = s.v.GetString(name + ".comment")
+		}
+
+		if comment == "" {
+			comment = path
+		}
+
+		log.Printf("%s: listing %s %s (%s)\n", name, pk.Type(), ssh.FingerprintSHA256(pk), comment)
+
+		lazykeys = append(lazykeys, &lazyKey{
+			name:    name,
+			path:    path,
+			comment: comment,
+			pk:      pk,
+		})
+	}
+
+	s.keysMutex.Lock()
+	s.lazykeys = lazykeys
+	s.keysMutex.Unlock()
+}
+
+// readPublicKey reads the public key of a private key file from the .pub file
+// next to it or from the unencrypted public part of an OpenSSH private key.
+func readPublicKey(path string) (ssh.PublicKey, string, error) {
+	if data, err := os.ReadFile(path + ".pub"); err == nil {
+		pk, comment, _, _, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s.pub: %w", path, err)
+		}
+
+		return pk, comment, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if err == nil {
+		return signer.PublicKey(), "", nil
+	}
+
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) && missing.PublicKey != nil {
+		return missing.PublicKey, "", nil
+	}
+
+	return nil, "", fmt.Errorf("%s: can't find public key: %w", path, err)
+}
+
+// listLazyKeys returns the configured keys that aren't in the keyring yet.
+func (s *SSHAgent) listLazyKeys(keys []*agent.Key) []*agent.Key {
+	s.keysMutex.RLock()
+	defer s.keysMutex.RUnlock()
+
+	if s.locked {
+		return keys
+	}
+
+	for _, lk := range s.lazykeys {
+		if _, ok := s.keys[string(lk.pk.Marshal())]; ok {
+			continue
+		}
+
+		keys = append(keys, &agent.Key{
+			Format:  lk.pk.Type(),
+			Blob:    lk.pk.Marshal(),
+			Comment: lk.comment,
+		})
+	}
+
+	return keys
+}
+
+// findLazyKey returns the configured key for pk if it isn't loaded yet.
+func (s *SSHAgent) findLazyKey(pk ssh.PublicKey) *lazyKey {
+	s.keysMutex.RLock()
+	defer s.keysMutex.RUnlock()
+
+	if _, ok := s.keys[string(pk.Marshal())]; ok {
+		return nil
+	}
+
+	for _, lk := range s.lazykeys {
+		if bytes.Equal(lk.pk.Marshal(), pk.Marshal()) {
+			return lk
+		}
+	}
+
+	return nil
+}
+
+// loadLazyKey decrypts the key file, asking the passphrase through pinentry,
+// and adds it to the agent.
+func (s *SSHAgent) loadLazyKey(lk *lazyKey) error {
+	lk.mutex.Lock()
+	defer lk.mutex.Unlock()
+
+	// another request may have loaded the key while we were waiting.
+	if s.findLazyKey(lk.pk) == nil {
+		return nil
+	}
+
+	data, err := os.ReadFile(lk.path)
+	if err != nil {
+		return err
+	}
+
+	privateKey, err := ssh.ParseRawPrivateKey(data)
+
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		var passphrase []byte
+
+		passphrase, err = getPassphrase("ssh-agentx key passphrase", fmt.Sprintf("Please enter the passphrase for %s (%s)\n%s", lk.comment, lk.path, ssh.FingerprintSHA256(lk.pk)))
+		if err != nil {
+			return err
+		}
+
+		privateKey, err = ssh.ParseRawPrivateKeyWithPassphrase(data, passphrase)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %w", lk.path, err)
+	}
+
+	added := agent.AddedKey{
+		PrivateKey:       privateKey,
+		Comment:          lk.comment,
+		ConfirmBeforeUse: s.v.GetBool(lk.name + ".confirm"),
+	}
+
+	if lifetime := s.v.GetDuration(lk.name + ".lifetime"); lifetime > 0 {
+		added.LifetimeSecs = uint32(lifetime.Seconds())
+	}
+
+	pk, err := addedKeyPublicKey(added)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(pk.Marshal(), lk.pk.Marshal()) {
+		return fmt.Errorf("%s: private key doesn't match public key", lk.path)
+	}
+
+	log.Printf("%s: loaded %s\n", lk.name, lk.path)
+
+	return s.Add(added)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// writeTestKeyFile writes the OpenSSH private key of seed to dir and returns
+// its path, with pub the public key is written next to it.
+func writeTestKeyFile(t *testing.T, dir string, seed byte, pub bool) (string, ssh.PublicKey) {
+	t.Helper()
+
+	key, pk := testEd25519Key(t, seed)
+
+	block, err := ssh.MarshalPrivateKey(*key, "file comment")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if pub {
+		if err := os.WriteFile(path+".pub", []byte(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pk)))+" pub comment\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return path, pk
+}
+
+func TestReadPublicKey(t *testing.T) {
+	for _, pub := range []bool{true, false} {
+		path, pk := writeTestKeyFile(t, t.TempDir(), 1, pub)
+
+		got, comment, err := readPublicKey(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := ""
+		if pub {
+			want = "pub comment"
+		}
+
+		if !bytes.Equal(got.Marshal(), pk.Marshal()) || comment != want {
+			t.Errorf("readPublicKey() = %s %q, want %s %q", ssh.FingerprintSHA256(got), comment, ssh.FingerprintSHA256(pk), want)
+		}
+	}
+
+	if _, _, err := readPublicKey(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("readPublicKey() of a missing file succeeded")
+	}
+}
+
+func TestLazyKey(t *testing.T) {
+	path, pk := writeTestKeyFile(t, t.TempDir(), 1, true)
+
+	s := newTestAgent(t, "[keys.work]\npath=\""+filepath.ToSlash(path)+"\"\ncomment=\"work\"\n")
+	s.loadKeyFiles()
+
+	keys, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 1 || keys[0].Comment != "work" || !bytes.Equal(keys[0].Blob, pk.Marshal()) {
+		t.Fatalf("List() = %v, want the key file", keys)
+	}
+
+	if len(s.keys) != 0 {
+		t.Fatal("key file loaded before it is used")
+	}
+
+	sig, err := s.Sign(pk, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pk.Verify([]byte("data"), sig); err != nil {
+		t.Error(err)
+	}
+
+	if s.findLazyKey(pk) != nil {
+		t.Error("key file still not loaded after signing")
+	}
+
+	// the loaded key is listed once
+	if keys, _ := s.List(); len(keys) != 1 {
+		t.Errorf("List() = %d keys, want 1", len(keys))
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"os"
 
 	"github.com/42wim/ssh-agentx/yubikey"
 	"github.com/spf13/viper"
@@ -12,8 +13,33 @@ import (
 var agentName = "ssh-agentx"
 
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(run(os.Args[2:]))
+		}
+	}
+
+	opts, err := parseFlags()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	ag := &SSHAgent{
 		ExtendedAgent: agent.NewKeyring().(agent.ExtendedAgent),
+		keys:          make(map[string]*keyInfo),
+		ratelimiter:   newRateLimiter(),
+		approvals:     newApprovalQueue(),
+		opts:          opts,
+	}
+
+	if opts.kill {
+		if err := ag.killAgent(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
 	}
 
 	v, err := ag.parseConfig()
@@ -25,6 +51,32 @@ func main() {
 		}
 	}
 
+	if opts.debug {
+		v.Set("yubikey.enablelog", true)
+	}
+
+	ag.v = v
+
+	if err := ag.loadPolicy(); err != nil {
+		log.Fatalln("invalid policy:", err)
+	}
+
+	if err := ag.loadRateLimits(); err != nil {
+		log.Fatalln("invalid rate limits:", err)
+	}
+
+	if err := ag.checkGPGSections(); err != nil {
+		log.Fatalln("invalid gpg configuration:", err)
+	}
+
+	if ag.findInstance() {
+		return
+	}
+
+	if ag.daemonize() {
+		return
+	}
+
 	if v.GetBool("yubikey.enable") {
 		yubi, err := yubikey.New()
 		if err != nil {
@@ -46,7 +98,25 @@ func main() {
 		ag.yubisigner = y
 	}
 
-	ag.v = v
+	if v.GetBool("store.enable") {
+		if err := ag.openStore(); err != nil {
+			log.Fatal("key store: ", err)
+		}
+	}
+
+	ag.loadKeyFiles()
+
+	if err := ag.checkGPGFingerprints(); err != nil {
+		log.Fatalln("gpg:", err)
+	}
+
+	if err := ag.openAudit(); err != nil {
+		log.Fatal("audit log: ", err)
+	}
+
+	if err := ag.startMetrics(); err != nil {
+		log.Fatal("metrics: ", err)
+	}
 
 	ag.start()
 }
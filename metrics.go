@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/42wim/ssh-agentx/yubikey"
+	"github.com/go-piv/piv-go/piv"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// metrics are the counters served in the Prometheus text format.
+type metrics struct {
+	mutex     sync.Mutex
+	requests  map[string]uint64
+	errors    map[[2]string]uint64
+	durations map[string]*histogram
+}
+
+type histogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:  make(map[string]uint64),
+		errors:    make(map[[2]string]uint64),
+		durations: make(map[string]*histogram),
+	}
+}
+
+// observe records a request for operation that started at start and ended
+// with err.
+func (m *metrics) observe(operation string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+
+	d := time.Since(start).Seconds()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.requests[operation]++
+
+	if err != nil {
+		m.errors[[2]string{operation, errorCause(err)}]++
+	}
+
+	h, ok := m.durations[operation]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(latencyBuckets))}
+		m.durations[operation] = h
+	}
+
+	for i, le := range latencyBuckets {
+		if d <= le {
+			h.buckets[i]++
+		}
+	}
+
+	h.sum += d
+	h.count++
+}
+
+// errorCause returns the metrics label for err.
+func errorCause(err error) string {
+	var authErr piv.AuthErr
+
+	switch {
+	case errors.Is(err, errLocked):
+		return "locked"
+	case errors.Is(err, errPolicyDenied):
+		return "policy_denied"
+	case errors.Is(err, errNotConfirmed):
+		return "not_confirmed"
+	case errors.Is(err, errApprovalDenied):
+		return "approval_denied"
+	case errors.Is(err, errApprovalTimeout):
+		return "approval_timeout"
+	case errors.Is(err, errNotPermitted):
+		return "not_permitted"
+	case errors.Is(err, errWindowClosed):
+		return "window_closed"
+	case errors.Is(err, errRateLimited):
+		return "rate_limited"
+	case errors.Is(err, errQuotaExceeded):
+		return "quota_exceeded"
+	case errors.Is(err, errAudit):
+		return "audit"
+	case errors.Is(err, errNoSigner):
+		return "no_signer"
+	case errors.Is(err, errAmbiguousSigner):
+		return "ambiguous_signer"
+	case errors.Is(err, errNotGitObject):
+		return "not_git_object"
+	case errors.Is(err, errIdentityMismatch):
+		return "identity_mismatch"
+	case errors.Is(err, errBadRequest):
+		return "bad_request"
+	case errors.Is(err, yubikey.ErrUnsupportedSlot):
+		return "unsupported_slot"
+	case errors.Is(err, agent.ErrExtensionUnsupported):
+		return "unsupported"
+	// piv doesn't wrap the errors of the PIN prompt
+	case errors.As(err, &authErr), strings.Contains(err.Error(), "pin prompt"), strings.Contains(err.Error(), "pin required"):
+		return "pin"
+	default:
+		return "other"
+	}
+}
+
+// startMetrics serves the metrics on the unix socket or loopback address
+// configured in metrics.listen.
+func (s *SSHAgent) startMetrics() error {
+	addr := s.v.GetString("metrics.listen")
+	if addr == "" {
+		return nil
+	}
+
+	var (
+		l   net.Listener
+		err error
+	)
+
+	if strings.HasPrefix(addr, "unix:") {
+		path := expandHome(strings.TrimPrefix(addr, "unix:"))
+
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+
+		l, err = net.Listen("unix", path)
+	} else {
+		host, _, splitErr := net.SplitHostPort(addr)
+		if splitErr != nil {
+			return splitErr
+		}
+
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return fmt.Errorf("%s is not a loopback address", addr)
+		}
+
+		l, err = net.Listen("tcp", addr)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	s.metrics = newMetrics()
+	s.metricsListener = l
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.writeMetrics(w)
+	})
+
+	go func() {
+		if err := http.Serve(l, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Println("metrics listener failed:", err)
+		}
+	}()
+
+	log.Println("serving metrics on", addr)
+
+	return nil
+}
+
+func (s *SSHAgent) writeMetrics(w io.Writer) {
+	m := s.metrics
+
+	m.mutex.Lock()
+
+	var operations []string
+	for op := range m.durations {
+		operations = append(operations, op)
+	}
+
+	sort.Strings(operations)
+
+	fmt.Fprintln(w, "# HELP ssh_agentx_requests_total Requests handled by the agent.")
+	fmt.Fprintln(w, "# TYPE ssh_agentx_requests_total counter")
+
+	for _, op := range operations {
+		fmt.Fprintf(w, "ssh_agentx_requests_total{operation=%q} %d\n", op, m.requests[op])
+	}
+
+	var causes [][2]string
+	for k := range m.errors {
+		causes = append(causes, k)
+	}
+
+	sort.Slice(causes, func(i, j int) bool {
+		if causes[i][0] != causes[j][0] {
+			return causes[i][0] < causes[j][0]
+		}
+
+		return causes[i][1] < causes[j][1]
+	})
+
+	fmt.Fprintln(w, "# HELP ssh_agentx_errors_total Failed requests by cause.")
+	fmt.Fprintln(w, "# TYPE ssh_agentx_errors_total counter")
+
+	for _, k := range causes {
+		fmt.Fprintf(w, "ssh_agentx_errors_total{operation=%q,cause=%q} %d\n", k[0], k[1], m.errors[k])
+	}
+
+	fmt.Fprintln(w, "# HELP ssh_agentx_request_duration_seconds Time taken to handle requests, including confirmations.")
+	fmt.Fprintln(w, "# TYPE ssh_agentx_request_duration_seconds histogram")
+
+	for _, op := range operations {
+		h := m.durations[op]
+
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(w, "ssh_agentx_request_duration_seconds_bucket{operation=%q,le=\"%g\"} %d\n", op, le, h.buckets[i])
+		}
+
+		fmt.Fprintf(w, "ssh_agentx_request_duration_seconds_bucket{operation=%q,le=\"+Inf\"} %d\n", op, h.count)
+		fmt.Fprintf(w, "ssh_agentx_request_duration_seconds_sum{operation=%q} %g\n", op, h.sum)
+		fmt.Fprintf(w, "ssh_agentx_request_duration_seconds_count{operation=%q} %d\n", op, h.count)
+	}
+
+	m.mutex.Unlock()
+
+	s.keysMutex.RLock()
+	keys, lazykeys := len(s.keys), len(s.lazykeys)
+
+	identities := 0
+	for _, k := range s.gpgkeys {
+		identities += len(k.signer.Identities)
+	}
+	s.keysMutex.RUnlock()
+
+	fmt.Fprintln(w, "# HELP ssh_agentx_keys Keys loaded in the agent.")
+	fmt.Fprintln(w, "# TYPE ssh_agentx_keys gauge")
+	fmt.Fprintf(w, "ssh_agentx_keys %d\n", keys)
+	fmt.Fprintln(w, "# HELP ssh_agentx_key_files Keys configured in [keys.*] sections.")
+	fmt.Fprintln(w, "# TYPE ssh_agentx_key_files gauge")
+	fmt.Fprintf(w, "ssh_agentx_key_files %d\n", lazykeys)
+	fmt.Fprintln(w, "# HELP ssh_agentx_gpg_identities GPG identities derived from the loaded keys.")
+	fmt.Fprintln(w, "# TYPE ssh_agentx_gpg_identities gauge")
+	fmt.Fprintf(w, "ssh_agentx_gpg_identities %d\n", identities)
+
+	if s.yubikey != nil {
+		connected := 0
+
+		s.mutex.RLock()
+		if s.yubikey.Connected() {
+			connected = 1
+		}
+		s.mutex.RUnlock()
+
+		fmt.Fprintln(w, "# HELP ssh_agentx_yubikey_connected Whether the yubikey responds.")
+		fmt.Fprintln(w, "# TYPE ssh_agentx_yubikey_connected gauge")
+		fmt.Fprintf(w, "ssh_agentx_yubikey_connected %d\n", connected)
+	}
+}
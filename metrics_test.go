@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/42wim/ssh-agentx/yubikey"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestErrorCause(t *testing.T) {
+	tests := []struct {
+		err   error
+		cause string
+	}{
+		{errLocked, "locked"},
+		{fmt.Errorf("policy: %w", errPolicyDenied), "policy_denied"},
+		{errNotConfirmed, "not_confirmed"},
+		{errNotPermitted, "not_permitted"},
+		{errAudit, "audit"},
+		{errNoSigner, "no_signer"},
+		{yubikey.ErrUnsupportedSlot, "unsupported_slot"},
+		{agent.ErrExtensionUnsupported, "unsupported"},
+		{errors.New("pin prompt failed"), "pin"},
+		{errors.New("something else"), "other"},
+	}
+
+	for _, tt := range tests {
+		if got := errorCause(tt.err); got != tt.cause {
+			t.Errorf("errorCause(%q) = %s, want %s", tt.err, got, tt.cause)
+		}
+	}
+}
+
+func TestMetricsObserve(t *testing.T) {
+	var m *metrics
+
+	// metrics are disabled when the listener isn't configured
+	m.observe("sign", time.Now(), nil)
+
+	m = newMetrics()
+	m.observe("sign", time.Now(), nil)
+	m.observe("sign", time.Now(), errLocked)
+	m.observe("sign", time.Now().Add(-2*time.Second), errLocked)
+
+	if m.requests["sign"] != 3 {
+		t.Errorf("requests = %d, want 3", m.requests["sign"])
+	}
+
+	if n := m.errors[[2]string{"sign", "locked"}]; n != 2 {
+		t.Errorf("locked errors = %d, want 2", n)
+	}
+
+	h := m.durations["sign"]
+	if h.count != 3 || h.buckets[0] != 2 || h.buckets[len(latencyBuckets)-1] != 3 {
+		t.Errorf("histogram count %d buckets %v, want 3 requests of which 2 in the first bucket", h.count, h.buckets)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	s := newTestAgent(t, "")
+	s.metrics = newMetrics()
+	s.metrics.observe("sign", time.Now(), nil)
+	s.metrics.observe(gpgSignExtension, time.Now(), errNotConfirmed)
+
+	var buf bytes.Buffer
+
+	s.writeMetrics(&buf)
+
+	for _, line := range []string{
+		`ssh_agentx_requests_total{operation="sign"} 1`,
+		`ssh_agentx_requests_total{operation="ssh-gpg-sign@42wim"} 1`,
+		`ssh_agentx_errors_total{operation="ssh-gpg-sign@42wim",cause="not_confirmed"} 1`,
+		`ssh_agentx_request_duration_seconds_bucket{operation="sign",le="+Inf"} 1`,
+		`ssh_agentx_request_duration_seconds_count{operation="sign"} 1`,
+		`ssh_agentx_keys 0`,
+		`ssh_agentx_gpg_identities 0`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("metrics don't contain %s:\n%s", line, buf.String())
+		}
+	}
+
+	if strings.Contains(buf.String(), "ssh_agentx_yubikey_connected") {
+		t.Error("metrics contain the yubikey without a yubikey")
+	}
+}
+
+func TestStartMetrics(t *testing.T) {
+	if err := newTestAgent(t, "[metrics]\nlisten=\"192.0.2.1:9100\"").startMetrics(); err == nil {
+		t.Error("startMetrics() accepted a non loopback address")
+	}
+
+	path := filepath.Join(t.TempDir(), "metrics.sock")
+
+	s := newTestAgent(t, "[metrics]\nlisten=\"unix:"+path+"\"")
+	if err := s.startMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.metricsListener.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+
+	resp, err := client.Get("http://localhost/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(body), "ssh_agentx_keys 0\n") {
+		t.Errorf("GET /metrics = %s", body)
+	}
+}
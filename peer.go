@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// peerCred is the identity of the process on the other end of a client
+// connection. It is nil when the platform can't tell us.
+type peerCred struct {
+	pid int
+	uid int
+	gid int
+	exe string
+
+	// session identifies the ssh session a forwarded request came through
+	session string
+}
+
+func (p *peerCred) String() string {
+	if p == nil {
+		return "unknown peer"
+	}
+
+	exe := p.exe
+	if exe == "" {
+		exe = "unknown executable"
+	}
+
+	desc := fmt.Sprintf("pid %d uid %d gid %d (%s)", p.pid, p.uid, p.gid, exe)
+
+	if p.session != "" {
+		desc += " forwarding session " + p.session
+	}
+
+	return desc
+}
+
+// isLocalPeer returns true when the peer credentials prove the client is this
+// ssh-agentx binary run by the same user, eg ssh-agentx approve. A connection
+// without a forwarded session-bind isn't enough, ssh clients before OpenSSH
+// 8.9 forward the agent without sending it.
+func isLocalPeer(p *peerCred) bool {
+	if p == nil || p.session != "" || p.exe == "" || p.uid != os.Getuid() {
+		return false
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return false
+	}
+
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+
+	return p.exe == exe
+}
+
+// peerAllowed checks the peer against the [clients] allowlist. Every
+// configured list must match, an empty list allows everything.
+func (s *SSHAgent) peerAllowed(p *peerCred) error {
+	uids := s.v.GetIntSlice("clients.uids")
+	gids := s.v.GetIntSlice("clients.gids")
+	exes := s.v.GetStringSlice("clients.exes")
+
+	if len(uids) == 0 && len(gids) == 0 && len(exes) == 0 {
+		return nil
+	}
+
+	if p == nil {
+		return fmt.Errorf("peer credentials unavailable")
+	}
+
+	if len(uids) > 0 && !containsInt(uids, p.uid) {
+		return fmt.Errorf("uid %d not allowed", p.uid)
+	}
+
+	if len(gids) > 0 && !containsInt(gids, p.gid) {
+		return fmt.Errorf("gid %d not allowed", p.gid)
+	}
+
+	if len(exes) > 0 {
+		if p.exe == "" {
+			return fmt.Errorf("executable of pid %d unknown", p.pid)
+		}
+
+		allowed := false
+
+		for _, exe := range exes {
+			if matchPattern(expandHome(exe), p.exe) {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return fmt.Errorf("executable %s not allowed", p.exe)
+		}
+	}
+
+	return nil
+}
+
+func containsInt(list []int, n int) bool {
+	for _, i := range list {
+		if i == n {
+			return true
+		}
+	}
+
+	return false
+}
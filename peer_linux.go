@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// getPeerCred reads SO_PEERCRED of a unix socket connection and resolves the
+// executable of the peer through /proc.
+func getPeerCred(c net.Conn) (*peerCred, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("not a unix socket connection")
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		cred    *syscall.Ucred
+		credErr error
+	)
+
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if credErr != nil {
+		return nil, credErr
+	}
+
+	p := &peerCred{
+		pid: int(cred.Pid),
+		uid: int(cred.Uid),
+		gid: int(cred.Gid),
+	}
+
+	// we may not be allowed to look at processes of other users
+	if exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", p.pid)); err == nil {
+		p.exe = exe
+	}
+
+	return p, nil
+}
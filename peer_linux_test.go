@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetPeerCred(t *testing.T) {
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	peer, err := getPeerCred(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if peer.pid != os.Getpid() || peer.uid != os.Getuid() || peer.gid != os.Getgid() || peer.exe != exe {
+		t.Errorf("getPeerCred() = %s, want pid %d uid %d gid %d (%s)", peer, os.Getpid(), os.Getuid(), os.Getgid(), exe)
+	}
+
+	if _, err := getPeerCred(client.(*net.UnixConn)); err != nil {
+		t.Errorf("getPeerCred() of the client side: %s", err)
+	}
+
+	p1, _ := net.Pipe()
+	if _, err := getPeerCred(p1); err == nil {
+		t.Error("getPeerCred() of a pipe didn't fail")
+	}
+}
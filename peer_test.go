@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestPeerAllowed(t *testing.T) {
+	peer := &peerCred{pid: 42, uid: 1000, gid: 100, exe: "/usr/bin/ssh"}
+
+	tests := []struct {
+		name    string
+		cfg     string
+		peer    *peerCred
+		allowed bool
+	}{
+		{"no allowlist", "", peer, true},
+		{"no allowlist unknown peer", "", nil, true},
+		{"uid", "[clients]\nuids=[0, 1000]", peer, true},
+		{"uid denied", "[clients]\nuids=[0]", peer, false},
+		{"gid", "[clients]\ngids=[100]", peer, true},
+		{"gid denied", "[clients]\ngids=[0]", peer, false},
+		{"exe", "[clients]\nexes=[\"/usr/bin/ssh\"]", peer, true},
+		{"exe glob", "[clients]\nexes=[\"/usr/*\"]", peer, true},
+		{"exe denied", "[clients]\nexes=[\"/usr/bin/git\"]", peer, false},
+		{"exe unknown", "[clients]\nexes=[\"/usr/bin/ssh\"]", &peerCred{pid: 42, uid: 1000, gid: 100}, false},
+		{"all lists", "[clients]\nuids=[1000]\ngids=[100]\nexes=[\"/usr/bin/ssh\"]", peer, true},
+		{"one list denied", "[clients]\nuids=[1000]\ngids=[0]", peer, false},
+		{"unknown peer", "[clients]\nuids=[1000]", nil, false},
+	}
+
+	for _, tt := range tests {
+		s := newTestAgent(t, tt.cfg)
+
+		err := s.peerAllowed(tt.peer)
+		if (err == nil) != tt.allowed {
+			t.Errorf("%s: peerAllowed() = %v, want allowed %v", tt.name, err, tt.allowed)
+		}
+	}
+}
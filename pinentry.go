@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/twpayne/go-pinentry-minimal/pinentry"
+	"golang.org/x/crypto/ssh"
+)
+
+var errNotConfirmed = errors.New("agent: confirmation denied")
+
+// defaultConfirmTimeout is used when confirmtimeout isn't set in the config.
+const defaultConfirmTimeout = 60 * time.Second
+
+// confirmKey asks the user for confirmation if the key was added with the
+// confirm constraint (ssh-add -c). GPG keys are derived from the private key,
+// so a certificate added with the constraint counts for the key as well.
+func (s *SSHAgent) confirmKey(pk ssh.PublicKey, action string) error {
+	if pk == nil {
+		return nil
+	}
+
+	var info *keyInfo
+
+	blob := underlyingKey(pk).Marshal()
+
+	s.keysMutex.RLock()
+	for _, k := range s.keys {
+		if k.confirm && bytes.Equal(underlyingKey(k.pk).Marshal(), blob) {
+			info = k
+			break
+		}
+	}
+	s.keysMutex.RUnlock()
+
+	if info == nil {
+		return nil
+	}
+
+	desc := fmt.Sprintf("Allow use of key %s?\n%s\nKey fingerprint %s.", info.comment, action, ssh.FingerprintSHA256(pk))
+
+	return s.confirm(desc)
+}
+
+// confirm shows a pinentry CONFIRM dialog and returns errNotConfirmed when the
+// user denies the request or it times out.
+func (s *SSHAgent) confirm(desc string) error {
+	timeout := defaultConfirmTimeout
+	if s.v.IsSet("confirmtimeout") {
+		timeout = s.v.GetDuration("confirmtimeout")
+	}
+
+	client, err := pinentry.NewClient(
+		pinentry.WithBinaryNameFromGnuPGAgentConf(),
+		pinentry.WithGPGTTY(),
+		pinentry.WithTitle("ssh-agentx confirmation"),
+		pinentry.WithDesc(desc),
+		pinentry.WithTimeout(timeout),
+	)
+	if err != nil {
+		log.Println("confirmation failed:", err)
+		return errNotConfirmed
+	}
+	defer client.Close()
+
+	ok, err := client.Confirm("")
+	if err != nil {
+		log.Println("confirmation failed:", err)
+		return errNotConfirmed
+	}
+
+	if !ok {
+		log.Println("confirmation denied")
+		return errNotConfirmed
+	}
+
+	return nil
+}
+
+// getPassphrase asks the user for a passphrase using pinentry.
+func getPassphrase(title, desc string) ([]byte, error) {
+	client, err := pinentry.NewClient(
+		pinentry.WithBinaryNameFromGnuPGAgentConf(),
+		pinentry.WithGPGTTY(),
+		pinentry.WithTitle(title),
+		pinentry.WithDesc(desc),
+		pinentry.WithPrompt("Passphrase:"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	pin, _, err := client.GetPIN()
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(pin), nil
+}
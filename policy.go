@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	policyAllow   = "allow"
+	policyDeny    = "deny"
+	policyConfirm = "confirm"
+	policyApprove = "approve"
+
+	// the requests that aren't extensions
+	policySignRequest = "sign"
+	policyListRequest = "list"
+)
+
+var errPolicyDenied = errors.New("agent: denied by policy")
+
+// requestMatcher are the fields of the [[policy]] and [[ratelimit]] rules that
+// select requests. Every field that is set must match the request, a list
+// matches when one of its entries matches. A certificate matches the
+// fingerprint of the key it was issued for.
+type requestMatcher struct {
+	Request     []string `mapstructure:"request"`
+	Fingerprint []string `mapstructure:"fingerprint"`
+	UID         []string `mapstructure:"uid"`
+	Slot        []string `mapstructure:"slot"`
+	PeerUID     []int    `mapstructure:"peeruid"`
+	Exe         []string `mapstructure:"exe"`
+	Time        string   `mapstructure:"time"`
+
+	// the time window in minutes since midnight
+	from, to int
+}
+
+// policyRule is a [[policy]] entry of the configuration. The first matching
+// rule decides, requests that match no rule are allowed.
+type policyRule struct {
+	requestMatcher `mapstructure:",squash"`
+
+	Name   string `mapstructure:"name"`
+	Action string `mapstructure:"action"`
+}
+
+// policyRequest is what the policy rules are matched against.
+type policyRequest struct {
+	request string
+	peer    *peerCred
+	pk      ssh.PublicKey
+	uid     string
+	slot    string
+}
+
+func (r policyRequest) String() string {
+	desc := r.request
+
+	if r.uid != "" {
+		desc += " for " + r.uid
+	}
+
+	if r.slot != "" {
+		desc += " on slot " + r.slot
+	}
+
+	if r.pk != nil {
+		desc += " with key " + ssh.FingerprintSHA256(underlyingKey(r.pk))
+	}
+
+	return desc + " by " + r.peer.String()
+}
+
+// session returns the forwarded ssh session of the request, all local requests
+// share the "local" session.
+func (r policyRequest) session() string {
+	if r.peer == nil || r.peer.session == "" {
+		return "local"
+	}
+
+	return r.peer.session
+}
+
+// loadPolicy parses the [[policy]] rules of the configuration.
+func (s *SSHAgent) loadPolicy() error {
+	var rules []policyRule
+
+	if err := s.v.UnmarshalKey("policy", &rules); err != nil {
+		return err
+	}
+
+	for i := range rules {
+		r := &rules[i]
+
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("#%d", i+1)
+		}
+
+		switch r.Action {
+		case policyAllow, policyDeny, policyConfirm, policyApprove:
+		default:
+			return fmt.Errorf("policy %s: action must be %s, %s, %s or %s", r.Name, policyAllow, policyDeny, policyConfirm, policyApprove)
+		}
+
+		if err := r.requestMatcher.init(); err != nil {
+			return fmt.Errorf("policy %s: %w", r.Name, err)
+		}
+	}
+
+	s.keysMutex.Lock()
+	s.policy = rules
+	s.keysMutex.Unlock()
+
+	return nil
+}
+
+func (r *requestMatcher) init() error {
+	if r.Time == "" {
+		return nil
+	}
+
+	var err error
+
+	r.from, r.to, err = parseTimeWindow(r.Time)
+	if err != nil {
+		return fmt.Errorf("invalid time %s: %w", r.Time, err)
+	}
+
+	return nil
+}
+
+// parseTimeWindow parses a time of day window like 09:00-17:30, the window
+// may span midnight (22:00-06:00).
+func parseTimeWindow(window string) (int, int, error) {
+	parts := strings.Split(window, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("expected hh:mm-hh:mm")
+	}
+
+	var minutes [2]int
+
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return 0, 0, err
+		}
+
+		minutes[i] = t.Hour()*60 + t.Minute()
+	}
+
+	return minutes[0], minutes[1], nil
+}
+
+// policyAction returns the action of the first rule matching req.
+func (s *SSHAgent) policyAction(req policyRequest) (string, string) {
+	s.keysMutex.RLock()
+	defer s.keysMutex.RUnlock()
+
+	now := time.Now()
+
+	for i := range s.policy {
+		if s.policy[i].matches(req, now) {
+			return s.policy[i].Action, s.policy[i].Name
+		}
+	}
+
+	return policyAllow, ""
+}
+
+// checkPolicy returns errPolicyDenied when the policy denies req and asks for
+// confirmation or approval when the policy requires it.
+func (s *SSHAgent) checkPolicy(req policyRequest) error {
+	action, name := s.policyAction(req)
+
+	switch action {
+	case policyDeny:
+		log.Printf("policy %s denies %s\n", name, req)
+		return errPolicyDenied
+	case policyConfirm:
+		return s.confirm(fmt.Sprintf("Allow %s?", req))
+	case policyApprove:
+		return s.waitApproval(req)
+	}
+
+	return nil
+}
+
+func (r *requestMatcher) matches(req policyRequest, now time.Time) bool {
+	if len(r.Request) > 0 && !matchAny(r.Request, req.request) {
+		return false
+	}
+
+	if len(r.Fingerprint) > 0 && (req.pk == nil || !matchAny(r.Fingerprint, ssh.FingerprintSHA256(underlyingKey(req.pk)))) {
+		return false
+	}
+
+	if len(r.UID) > 0 && (req.uid == "" || !matchAny(r.UID, req.uid)) {
+		return false
+	}
+
+	if len(r.Slot) > 0 && (req.slot == "" || !matchAny(r.Slot, req.slot)) {
+		return false
+	}
+
+	if len(r.PeerUID) > 0 && (req.peer == nil || !containsInt(r.PeerUID, req.peer.uid)) {
+		return false
+	}
+
+	if len(r.Exe) > 0 && (req.peer == nil || req.peer.exe == "" || !matchAny(r.Exe, req.peer.exe)) {
+		return false
+	}
+
+	if r.Time != "" {
+		minute := now.Hour()*60 + now.Minute()
+
+		if r.from <= r.to && (minute < r.from || minute >= r.to) {
+			return false
+		}
+
+		if r.from > r.to && minute < r.from && minute >= r.to {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if matchPattern(p, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// extensionPolicyRequest returns the policy request for the yubikey and info
+// extensions.
+func (s *SSHAgent) extensionPolicyRequest(peer *peerCred, extensionType string, contents []byte) policyRequest {
+	req := policyRequest{
+		request: extensionType,
+		peer:    peer,
+	}
+
+	if s.yubikey == nil {
+		return req
+	}
+
+	switch extensionType {
+	case yubiSetSlotExtension:
+		req.slot = string(contents)
+		if req.slot == "" {
+			req.slot = "9a"
+		}
+	case yubiSignExtension, yubiPublicKeyExtension:
+		s.mutex.RLock()
+		req.slot = s.yubikey.GetSlot()
+		if s.yubisigner != nil {
+			req.pk, _ = ssh.NewPublicKey(s.yubisigner.Public())
+		}
+		s.mutex.RUnlock()
+	}
+
+	return req
+}
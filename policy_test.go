@@ -0,0 +1,145 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseTimeWindow(t *testing.T) {
+	tests := []struct {
+		window   string
+		from, to int
+		ok       bool
+	}{
+		{"09:00-17:30", 9 * 60, 17*60 + 30, true},
+		{"22:00-06:00", 22 * 60, 6 * 60, true},
+		{" 08:15 - 12:00 ", 8*60 + 15, 12 * 60, true},
+		{"00:00-23:59", 0, 23*60 + 59, true},
+		{"09:00", 0, 0, false},
+		{"09:00-17:00-18:00", 0, 0, false},
+		{"9am-5pm", 0, 0, false},
+		{"24:00-06:00", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		from, to, err := parseTimeWindow(tt.window)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseTimeWindow(%q) error = %v, want ok %v", tt.window, err, tt.ok)
+			continue
+		}
+
+		if tt.ok && (from != tt.from || to != tt.to) {
+			t.Errorf("parseTimeWindow(%q) = %d, %d, want %d, %d", tt.window, from, to, tt.from, tt.to)
+		}
+	}
+}
+
+func TestRequestMatcherTime(t *testing.T) {
+	day := func(hour, minute int) time.Time {
+		return time.Date(2024, 4, 29, hour, minute, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		window string
+		now    time.Time
+		want   bool
+	}{
+		{"09:00-17:00", day(9, 0), true},
+		{"09:00-17:00", day(16, 59), true},
+		{"09:00-17:00", day(17, 0), false},
+		{"09:00-17:00", day(8, 59), false},
+		{"22:00-06:00", day(23, 0), true},
+		{"22:00-06:00", day(2, 0), true},
+		{"22:00-06:00", day(6, 0), false},
+		{"22:00-06:00", day(12, 0), false},
+	}
+
+	for _, tt := range tests {
+		r := requestMatcher{Time: tt.window}
+		if err := r.init(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := r.matches(policyRequest{request: policySignRequest}, tt.now); got != tt.want {
+			t.Errorf("time %s at %s = %v, want %v", tt.window, tt.now.Format("15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestPolicyAction(t *testing.T) {
+	_, pk := testEd25519Key(t, 1)
+	_, other := testEd25519Key(t, 2)
+
+	fp := ssh.FingerprintSHA256(pk)
+	cert := testCertificate(t, pk)
+
+	s := newTestAgent(t, `
+[[policy]]
+name="no-yubikey-from-ssh"
+request=["ssh-yubi-*"]
+exe=["/usr/bin/ssh"]
+action="deny"
+
+[[policy]]
+name="key-prefix"
+request=["sign"]
+fingerprint=["`+fp[:len("SHA256:")+20]+`*"]
+action="confirm"
+
+[[policy]]
+name="work"
+request=["ssh-gpg-sign@42wim"]
+uid=["* <*@work>"]
+peeruid=[1000]
+action="approve"
+
+[[policy]]
+request=["ssh-gpg-sign@42wim"]
+action="deny"
+`)
+
+	if err := s.loadPolicy(); err != nil {
+		t.Fatal(err)
+	}
+
+	sshPeer := &peerCred{uid: 1000, exe: "/usr/bin/ssh"}
+	git := &peerCred{uid: 1000, exe: "/usr/bin/git"}
+	root := &peerCred{uid: 0, exe: "/usr/bin/git"}
+
+	tests := []struct {
+		name   string
+		req    policyRequest
+		action string
+		rule   string
+	}{
+		{"yubikey through ssh", policyRequest{request: yubiSignExtension, peer: sshPeer}, policyDeny, "no-yubikey-from-ssh"},
+		{"yubikey locally", policyRequest{request: yubiSignExtension, peer: git}, policyAllow, ""},
+		{"yubikey unknown peer", policyRequest{request: yubiSignExtension}, policyAllow, ""},
+		{"sign with key", policyRequest{request: policySignRequest, peer: git, pk: pk}, policyConfirm, "key-prefix"},
+		{"sign with certificate of key", policyRequest{request: policySignRequest, peer: git, pk: cert}, policyConfirm, "key-prefix"},
+		{"sign with other key", policyRequest{request: policySignRequest, peer: git, pk: other}, policyAllow, ""},
+		{"gpg work", policyRequest{request: gpgSignExtension, peer: git, uid: "yourname <you@work>"}, policyApprove, "work"},
+		{"gpg work as root", policyRequest{request: gpgSignExtension, peer: root, uid: "yourname <you@work>"}, policyDeny, "#4"},
+		{"gpg home", policyRequest{request: gpgSignExtension, peer: git, uid: "yourname <you@home>"}, policyDeny, "#4"},
+	}
+
+	for _, tt := range tests {
+		action, rule := s.policyAction(tt.req)
+		if action != tt.action || rule != tt.rule {
+			t.Errorf("%s: policyAction() = %s, %s, want %s, %s", tt.name, action, rule, tt.action, tt.rule)
+		}
+	}
+}
+
+func TestLoadPolicyInvalid(t *testing.T) {
+	for _, cfg := range []string{
+		"[[policy]]\naction=\"maybe\"\n",
+		"[[policy]]\naction=\"deny\"\ntime=\"always\"\n",
+	} {
+		if err := newTestAgent(t, cfg).loadPolicy(); err == nil {
+			t.Errorf("loadPolicy() accepted %q", cfg)
+		}
+	}
+}
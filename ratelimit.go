@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// alertInterval is how often the same limit raises an alert.
+const alertInterval = time.Minute
+
+var (
+	errRateLimited   = errors.New("agent: rate limit exceeded")
+	errQuotaExceeded = errors.New("agent: signing quota exceeded")
+)
+
+// rateLimitRule is a [[ratelimit]] entry of the configuration. All matching
+// rules apply. Every combination of request, key and slot gets its own token
+// bucket of burst tokens that refills with rate tokens per per. The quota is
+// the maximum number of requests per session in quotaperiod.
+type rateLimitRule struct {
+	requestMatcher `mapstructure:",squash"`
+
+	Name        string        `mapstructure:"name"`
+	Rate        float64       `mapstructure:"rate"`
+	Per         time.Duration `mapstructure:"per"`
+	Burst       int           `mapstructure:"burst"`
+	Quota       int           `mapstructure:"quota"`
+	QuotaPeriod time.Duration `mapstructure:"quotaperiod"`
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type quotaWindow struct {
+	start time.Time
+	count int
+}
+
+// rateLimiter keeps the state of the [[ratelimit]] rules.
+type rateLimiter struct {
+	mutex   sync.Mutex
+	rules   []rateLimitRule
+	buckets map[string]*tokenBucket
+	quotas  map[string]*quotaWindow
+	alerts  map[string]time.Time
+}
+
+// loadRateLimits parses the [[ratelimit]] rules of the configuration. The
+// state of the existing limits is kept.
+func (s *SSHAgent) loadRateLimits() error {
+	var rules []rateLimitRule
+
+	if err := s.v.UnmarshalKey("ratelimit", &rules); err != nil {
+		return err
+	}
+
+	for i := range rules {
+		r := &rules[i]
+
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("#%d", i+1)
+		}
+
+		if r.Rate <= 0 && r.Quota <= 0 {
+			return fmt.Errorf("ratelimit %s: needs a rate or a quota", r.Name)
+		}
+
+		if r.Per <= 0 {
+			r.Per = time.Minute
+		}
+
+		if r.Burst <= 0 {
+			r.Burst = int(r.Rate)
+			if r.Burst < 1 {
+				r.Burst = 1
+			}
+		}
+
+		if err := r.requestMatcher.init(); err != nil {
+			return fmt.Errorf("ratelimit %s: %w", r.Name, err)
+		}
+	}
+
+	rl := s.ratelimiter
+
+	rl.mutex.Lock()
+	rl.rules = rules
+	rl.mutex.Unlock()
+
+	return nil
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		quotas:  make(map[string]*quotaWindow),
+		alerts:  make(map[string]time.Time),
+	}
+}
+
+// checkRateLimit checks the buckets and quotas of the rules matching req, with
+// take it also takes a token of every bucket and counts req against every
+// quota. Nothing is taken when one of them is exhausted.
+func (s *SSHAgent) checkRateLimit(req policyRequest, take bool) error {
+	rl := s.ratelimiter
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	now := time.Now()
+
+	var (
+		buckets []*tokenBucket
+		quotas  []*quotaWindow
+	)
+
+	for i := range rl.rules {
+		r := &rl.rules[i]
+
+		if !r.matches(req, now) {
+			continue
+		}
+
+		if r.Rate > 0 {
+			key := strings.Join([]string{r.Name, req.request, fingerprint(req.pk), req.slot}, "\x00")
+
+			b, ok := rl.buckets[key]
+			if !ok {
+				b = &tokenBucket{tokens: float64(r.Burst), last: now}
+				rl.buckets[key] = b
+			}
+
+			b.tokens += now.Sub(b.last).Seconds() * r.Rate / r.Per.Seconds()
+			if b.tokens > float64(r.Burst) {
+				b.tokens = float64(r.Burst)
+			}
+
+			b.last = now
+
+			if b.tokens < 1 {
+				err := fmt.Errorf("%w: %s allows %g requests per %s", errRateLimited, r.Name, r.Rate, r.Per)
+				s.alert(key, fmt.Sprintf("refused %s: %s", req, err))
+
+				return err
+			}
+
+			buckets = append(buckets, b)
+		}
+
+		if r.Quota > 0 {
+			key := r.Name + "\x00" + req.session()
+
+			q, ok := rl.quotas[key]
+			if !ok || (r.QuotaPeriod > 0 && now.Sub(q.start) >= r.QuotaPeriod) {
+				q = &quotaWindow{start: now}
+				rl.quotas[key] = q
+			}
+
+			if q.count >= r.Quota {
+				err := fmt.Errorf("%w: %s allows %d requests per session", errQuotaExceeded, r.Name, r.Quota)
+				if r.QuotaPeriod > 0 {
+					err = fmt.Errorf("%w: %s allows %d requests per session in %s", errQuotaExceeded, r.Name, r.Quota, r.QuotaPeriod)
+				}
+
+				s.alert(key, fmt.Sprintf("refused %s: %s", req, err))
+
+				return err
+			}
+
+			quotas = append(quotas, q)
+		}
+	}
+
+	if !take {
+		return nil
+	}
+
+	for _, b := range buckets {
+		b.tokens--
+	}
+
+	for _, q := range quotas {
+		q.count++
+	}
+
+	return nil
+}
+
+// alert logs msg and runs the alertcommand with msg as last argument, at most
+// once per alertInterval for the same key. Must be called with the mutex of
+// the rate limiter held.
+func (s *SSHAgent) alert(key, msg string) {
+	log.Println("ALERT:", msg)
+
+	rl := s.ratelimiter
+
+	if last, ok := rl.alerts[key]; ok && time.Since(last) < alertInterval {
+		return
+	}
+
+	rl.alerts[key] = time.Now()
+
+	s.runAlertCommand(msg)
+}
+
+// runAlertCommand runs the alertcommand with msg as last argument.
+func (s *SSHAgent) runAlertCommand(msg string) {
+	command := s.v.GetStringSlice("alertcommand")
+	if len(command) == 0 {
+		return
+	}
+
+	cmd := exec.Command(command[0], append(command[1:], msg)...)
+
+	go func() {
+		if out, err := cmd.CombinedOutput(); err != nil {
+			log.Printf("alertcommand failed: %s: %s\n", err, out)
+		}
+	}()
+}
+
+// authorize checks the rate limits and the policy for req. The limits aren't
+// used up here, so a request refused by the policy, a confirmation or strict
+// mode doesn't count. Call chargeRateLimit when req is going to be done.
+func (s *SSHAgent) authorize(req policyRequest) error {
+	if err := s.checkRateLimit(req, false); err != nil {
+		return err
+	}
+
+	return s.checkPolicy(req)
+}
+
+// chargeRateLimit counts req against the rate limits, it fails when another
+// request used them up since req was authorized.
+func (s *SSHAgent) chargeRateLimit(req policyRequest) error {
+	return s.checkRateLimit(req, true)
+}
+
+// fingerprint returns the fingerprint pk is limited by, a certificate shares
+// the limits of the key it was issued for.
+func fingerprint(pk ssh.PublicKey) string {
+	if pk == nil {
+		return ""
+	}
+
+	return ssh.FingerprintSHA256(underlyingKey(pk))
+}
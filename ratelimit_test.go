@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestRateLimitBucket(t *testing.T) {
+	_, pk := testEd25519Key(t, 1)
+	_, other := testEd25519Key(t, 2)
+
+	s := newTestAgent(t, `
+[[ratelimit]]
+name="sign"
+request="sign"
+rate=1
+per="1h"
+burst=2
+`)
+
+	if err := s.loadRateLimits(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := policyRequest{request: policySignRequest, pk: pk}
+
+	// authorizing doesn't use up tokens
+	for i := 0; i < 3; i++ {
+		if err := s.authorize(req); err != nil {
+			t.Fatalf("authorize() #%d error = %v", i+1, err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.chargeRateLimit(req); err != nil {
+			t.Fatalf("chargeRateLimit() #%d error = %v", i+1, err)
+		}
+	}
+
+	if err := s.authorize(req); !errors.Is(err, errRateLimited) {
+		t.Errorf("authorize() of an empty bucket error = %v, want %v", err, errRateLimited)
+	}
+
+	if err := s.chargeRateLimit(req); !errors.Is(err, errRateLimited) {
+		t.Errorf("chargeRateLimit() of an empty bucket error = %v, want %v", err, errRateLimited)
+	}
+
+	// a certificate shares the bucket of its key
+	if err := s.chargeRateLimit(policyRequest{request: policySignRequest, pk: testCertificate(t, pk)}); !errors.Is(err, errRateLimited) {
+		t.Errorf("chargeRateLimit() of a certificate of the key error = %v, want %v", err, errRateLimited)
+	}
+
+	// every key has its own bucket
+	if err := s.chargeRateLimit(policyRequest{request: policySignRequest, pk: other}); err != nil {
+		t.Errorf("chargeRateLimit() of another key error = %v", err)
+	}
+
+	// other requests don't match the rule
+	if err := s.chargeRateLimit(policyRequest{request: gpgSignExtension, pk: pk}); err != nil {
+		t.Errorf("chargeRateLimit() of a gpg request error = %v", err)
+	}
+
+	// refill one token
+	for _, b := range s.ratelimiter.buckets {
+		b.last = b.last.Add(-time.Hour)
+	}
+
+	if err := s.chargeRateLimit(req); err != nil {
+		t.Errorf("chargeRateLimit() after an hour error = %v", err)
+	}
+
+	if err := s.chargeRateLimit(req); !errors.Is(err, errRateLimited) {
+		t.Errorf("chargeRateLimit() after the refill error = %v, want %v", err, errRateLimited)
+	}
+}
+
+func TestRateLimitQuota(t *testing.T) {
+	s := newTestAgent(t, `
+[[ratelimit]]
+name="yubikey"
+request="ssh-yubi-*"
+quota=2
+quotaperiod="1h"
+`)
+
+	if err := s.loadRateLimits(); err != nil {
+		t.Fatal(err)
+	}
+
+	local := policyRequest{request: yubiSignExtension}
+	forwarded := policyRequest{request: yubiSignExtension, peer: &peerCred{session: "0011223344556677"}}
+
+	for i := 0; i < 2; i++ {
+		if err := s.chargeRateLimit(local); err != nil {
+			t.Fatalf("chargeRateLimit() #%d error = %v", i+1, err)
+		}
+	}
+
+	if err := s.chargeRateLimit(local); !errors.Is(err, errQuotaExceeded) {
+		t.Errorf("chargeRateLimit() over the quota error = %v, want %v", err, errQuotaExceeded)
+	}
+
+	// every session has its own quota
+	if err := s.chargeRateLimit(forwarded); err != nil {
+		t.Errorf("chargeRateLimit() of another session error = %v", err)
+	}
+
+	for _, q := range s.ratelimiter.quotas {
+		q.start = q.start.Add(-time.Hour)
+	}
+
+	if err := s.chargeRateLimit(local); err != nil {
+		t.Errorf("chargeRateLimit() in a new quota period error = %v", err)
+	}
+}
+
+func TestLoadRateLimitsInvalid(t *testing.T) {
+	for _, cfg := range []string{
+		"[[ratelimit]]\nrequest=\"sign\"\n",
+		"[[ratelimit]]\nrate=1\ntime=\"always\"\n",
+	} {
+		if err := newTestAgent(t, cfg).loadRateLimits(); err == nil {
+			t.Errorf("loadRateLimits() accepted %q", cfg)
+		}
+	}
+}
+
+func TestRateLimitPolicyDenied(t *testing.T) {
+	key, pk := testEd25519Key(t, 1)
+
+	s := newTestAgent(t, `
+[[policy]]
+name="no-root"
+request="sign"
+peeruid=[0]
+action="deny"
+
+[[ratelimit]]
+name="sign"
+request="sign"
+rate=1
+per="1h"
+burst=1
+`)
+
+	if err := s.loadPolicy(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.loadRateLimits(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Add(agent.AddedKey{PrivateKey: key, Comment: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	root := s.newConnAgent(&peerCred{uid: 0})
+	user := s.newConnAgent(&peerCred{uid: 1000})
+
+	// requests refused by the policy don't use up the bucket
+	for i := 0; i < 3; i++ {
+		if _, err := root.signWithFlags(pk, []byte("data"), 0); !errors.Is(err, errPolicyDenied) {
+			t.Fatalf("signWithFlags() as root error = %v, want %v", err, errPolicyDenied)
+		}
+	}
+
+	if _, err := user.signWithFlags(pk, []byte("data"), 0); err != nil {
+		t.Fatalf("signWithFlags() error = %v", err)
+	}
+
+	if _, err := user.signWithFlags(pk, []byte("data"), 0); !errors.Is(err, errRateLimited) {
+		t.Errorf("signWithFlags() of an empty bucket error = %v, want %v", err, errRateLimited)
+	}
+}
@@ -0,0 +1,729 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// See [PROTOCOL.agent] section 4.2.6 and 4.7 of OpenSSH
+var (
+	sessionBindExtension         = "session-bind@openssh.com"
+	restrictDestinationExtension = "restrict-destination-v00@openssh.com"
+)
+
+// maxSessionBindings is the number of hops we keep per connection, same as
+// AGENT_MAX_SESSION_IDS in OpenSSH.
+const maxSessionBindings = 16
+
+var errNotPermitted = errors.New("agent: key not permitted for this destination")
+
+// sessionBinding is a session bound to a connection with session-bind@openssh.com.
+type sessionBinding struct {
+	hostKey   ssh.PublicKey
+	sessionID []byte
+	forwarded bool
+}
+
+type destConstraintHop struct {
+	user     string
+	hostname string
+	keys     []ssh.PublicKey
+	isCA     []bool
+}
+
+// destConstraint is a single from -> to hop of a restrict-destination-v00@openssh.com
+// constraint added by ssh-add -h.
+type destConstraint struct {
+	from destConstraintHop
+	to   destConstraintHop
+}
+
+// connAgent is the agent served to a single client connection, it keeps track
+// of the peer and the sessions bound to this connection.
+type connAgent struct {
+	*SSHAgent
+	peer     *peerCred
+	bindings []sessionBinding
+}
+
+func (s *SSHAgent) newConnAgent(peer *peerCred) *connAgent {
+	return &connAgent{SSHAgent: s, peer: peer}
+}
+
+func (c *connAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	if extensionType == sessionBindExtension {
+		return nil, c.handleSessionBind(contents)
+	}
+
+	switch extensionType {
+	case gpgSignExtension, yubiSignExtension, yubiPublicKeyExtension, yubiSetSlotExtension, yubiWindowExtension, infoExtension:
+		start := time.Now()
+
+		res, err := c.extension(extensionType, contents)
+		c.metrics.observe(extensionType, start, err)
+
+		if extensionType == gpgSignExtension && isGPGSignV2(contents) {
+			return gpgSignReply(res, err), nil
+		}
+
+		return res, err
+	}
+
+	return c.extension(extensionType, contents)
+}
+
+func (c *connAgent) extension(extensionType string, contents []byte) ([]byte, error) {
+	if err := c.extensionPermitted(extensionType); err != nil {
+		return nil, err
+	}
+
+	return c.SSHAgent.handleExtension(c, extensionType, contents)
+}
+
+func (c *connAgent) List() ([]*agent.Key, error) {
+	keys, err := c.SSHAgent.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var permitted []*agent.Key
+
+	for _, k := range keys {
+		info := c.keyInfo(k)
+		if info != nil && c.identityPermitted(info, "", false) != nil {
+			continue
+		}
+
+		// confirmation is asked when the key is used
+		action, _ := c.policyAction(policyRequest{request: policyListRequest, peer: c.requestPeer(), pk: k})
+		if action == policyDeny {
+			continue
+		}
+
+		permitted = append(permitted, k)
+	}
+
+	return permitted, nil
+}
+
+func (c *connAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return c.SignWithFlags(key, data, 0)
+}
+
+func (c *connAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	start := time.Now()
+
+	sig, err := c.signWithFlags(key, data, flags)
+	c.metrics.observe("sign", start, err)
+
+	if err := c.auditRecord(&auditEntry{Operation: auditSSHSign, Key: ssh.FingerprintSHA256(key)}, c.requestPeer(), data, err); err != nil {
+		return nil, err
+	}
+
+	return sig, err
+}
+
+func (c *connAgent) signWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if info := c.keyInfo(key); info != nil && len(info.destinations) > 0 {
+		if err := c.signPermitted(info, data); err != nil {
+			log.Printf("refusing use of key %s: %s\n", ssh.FingerprintSHA256(key), err)
+			return nil, errNotPermitted
+		}
+	}
+
+	req := policyRequest{request: policySignRequest, peer: c.requestPeer(), pk: key}
+
+	if err := c.authorize(req); err != nil {
+		return nil, err
+	}
+
+	return c.SSHAgent.signKey(req, key, data, flags)
+}
+
+// requestPeer returns the peer of the connection together with the forwarded
+// ssh session the requests come through.
+func (c *connAgent) requestPeer() *peerCred {
+	if len(c.bindings) == 0 || !c.bindings[0].forwarded {
+		return c.peer
+	}
+
+	var p peerCred
+	if c.peer != nil {
+		p = *c.peer
+	}
+
+	id := c.bindings[0].sessionID
+	if len(id) > 16 {
+		id = id[:16]
+	}
+
+	p.session = hex.EncodeToString(id)
+
+	return &p
+}
+
+func (c *connAgent) keyInfo(pk ssh.PublicKey) *keyInfo {
+	c.keysMutex.RLock()
+	defer c.keysMutex.RUnlock()
+
+	return c.keys[string(pk.Marshal())]
+}
+
+// gpgSignerPermitted checks the destination constraints of the keys the GPG key
+// signer is derived from, it can only be used where these keys can be used.
+func (c *connAgent) gpgSignerPermitted(signer *GPGKey) error {
+	c.keysMutex.RLock()
+	defer c.keysMutex.RUnlock()
+
+	for _, info := range c.keys {
+		if !bytes.Equal(underlyingKey(info.pk).Marshal(), signer.pk.Marshal()) {
+			continue
+		}
+
+		if err := c.identityPermitted(info, "", false); err != nil {
+			log.Printf("refusing GPG signature with key %s: %s\n", ssh.FingerprintSHA256(info.pk), err)
+			return errNotPermitted
+		}
+	}
+
+	return nil
+}
+
+// handleSessionBind verifies the hostkey signature over the session identifier
+// and records the binding on this connection.
+func (c *connAgent) handleSessionBind(contents []byte) error {
+	var req struct {
+		HostKey      []byte
+		SessionID    []byte
+		Signature    []byte
+		IsForwarding bool
+	}
+
+	if err := ssh.Unmarshal(contents, &req); err != nil {
+		return err
+	}
+
+	hostKey, err := ssh.ParsePublicKey(req.HostKey)
+	if err != nil {
+		return err
+	}
+
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(req.Signature, &sig); err != nil {
+		return err
+	}
+
+	if err := hostKey.Verify(req.SessionID, &sig); err != nil {
+		return fmt.Errorf("session-bind: %w", err)
+	}
+
+	for _, b := range c.bindings {
+		if !b.forwarded {
+			return errors.New("session-bind: connection already bound for authentication")
+		}
+
+		if bytes.Equal(b.sessionID, req.SessionID) {
+			if bytes.Equal(b.hostKey.Marshal(), hostKey.Marshal()) {
+				return nil
+			}
+
+			return errors.New("session-bind: session ID bound to different hostkey")
+		}
+	}
+
+	if len(c.bindings) >= maxSessionBindings {
+		return errors.New("session-bind: too many bound sessions")
+	}
+
+	c.bindings = append(c.bindings, sessionBinding{
+		hostKey:   hostKey,
+		sessionID: req.SessionID,
+		forwarded: req.IsForwarding,
+	})
+
+	return nil
+}
+
+// signPermitted checks a sign request for a destination restricted key, the data
+// must be a userauth request for the session most recently bound to the connection.
+func (c *connAgent) signPermitted(info *keyInfo, data []byte) error {
+	if len(c.bindings) == 0 {
+		return errors.New("destination restricted key used on unbound connection")
+	}
+
+	user, sessionID, hostKey, err := parseUserauthRequest(data, info.pk)
+	if err != nil {
+		return err
+	}
+
+	if err := c.identityPermitted(info, user, true); err != nil {
+		return err
+	}
+
+	last := c.bindings[len(c.bindings)-1]
+
+	if !bytes.Equal(sessionID, last.sessionID) {
+		return errors.New("unexpected session ID in sign request")
+	}
+
+	if len(c.bindings) > 1 && hostKey == nil {
+		return errors.New("no hostkey in sign request for forwarded connection")
+	}
+
+	if hostKey != nil && !bytes.Equal(hostKey.Marshal(), last.hostKey.Marshal()) {
+		return errors.New("hostkey in sign request doesn't match bound session")
+	}
+
+	return nil
+}
+
+// identityPermitted walks the hops bound to this connection and checks that every
+// hop is allowed by the destination constraints of the key.
+func (c *connAgent) identityPermitted(info *keyInfo, user string, signing bool) error {
+	if len(info.destinations) == 0 || len(c.bindings) == 0 {
+		return nil
+	}
+
+	var fromKey ssh.PublicKey
+
+	for i, b := range c.bindings {
+		checkUser := false
+
+		if i == len(c.bindings)-1 {
+			checkUser = signing
+			if b.forwarded && signing {
+				return errors.New("user specified on forwarded connection")
+			}
+		} else if !b.forwarded {
+			return errors.New("tried to forward through signing bind")
+		}
+
+		if !info.permittedDestination(fromKey, b.hostKey, user, checkUser) {
+			return errNotPermitted
+		}
+
+		fromKey = b.hostKey
+	}
+
+	// hide keys that may be used to authenticate to the forwarding host but not
+	// beyond it.
+	last := c.bindings[len(c.bindings)-1]
+	if last.forwarded && !signing && !info.permittedDestination(last.hostKey, nil, "", false) {
+		return errNotPermitted
+	}
+
+	return nil
+}
+
+func (info *keyInfo) permittedDestination(fromKey, toKey ssh.PublicKey, user string, checkUser bool) bool {
+	for _, d := range info.destinations {
+		if fromKey == nil {
+			if d.from.hostname != "" || len(d.from.keys) != 0 {
+				continue
+			}
+		} else if !d.from.matchKey(fromKey) {
+			continue
+		}
+
+		if toKey != nil && !d.to.matchKey(toKey) {
+			continue
+		}
+
+		if checkUser && d.to.user != "" && !matchPattern(d.to.user, user) {
+			continue
+		}
+
+		return true
+	}
+
+	return false
+}
+
+func (h *destConstraintHop) matchKey(key ssh.PublicKey) bool {
+	for i, k := range h.keys {
+		if !h.isCA[i] {
+			if bytes.Equal(k.Marshal(), key.Marshal()) {
+				return true
+			}
+
+			continue
+		}
+
+		cert, ok := key.(*ssh.Certificate)
+		if !ok || cert.CertType != ssh.HostCert {
+			continue
+		}
+
+		if !bytes.Equal(cert.SignatureKey.Marshal(), k.Marshal()) {
+			continue
+		}
+
+		if err := new(ssh.CertChecker).CheckCert(h.hostname, cert); err != nil {
+			continue
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// parseUserauthRequest parses a SSH2_MSG_USERAUTH_REQUEST as signed by a client
+// during publickey authentication.
+func parseUserauthRequest(data []byte, pk ssh.PublicKey) (string, []byte, ssh.PublicKey, error) {
+	var req struct {
+		SessionID []byte
+		Type      uint8
+		User      string
+		Service   string
+		Method    string
+		HasSig    bool
+		Algo      string
+		PubKey    []byte
+		Rest      []byte `ssh:"rest"`
+	}
+
+	if err := ssh.Unmarshal(data, &req); err != nil {
+		return "", nil, nil, errors.New("sign request is not a userauth request")
+	}
+
+	if req.Type != 50 || !req.HasSig {
+		return "", nil, nil, errors.New("sign request is not a userauth request")
+	}
+
+	if !bytes.Equal(req.PubKey, pk.Marshal()) {
+		return "", nil, nil, errors.New("key in userauth request doesn't match")
+	}
+
+	switch req.Method {
+	case "publickey":
+		if len(req.Rest) != 0 {
+			return "", nil, nil, errors.New("trailing data in userauth request")
+		}
+
+		return req.User, req.SessionID, nil, nil
+	case "publickey-hostbound-v00@openssh.com":
+		var hb struct {
+			HostKey []byte
+		}
+
+		if err := ssh.Unmarshal(req.Rest, &hb); err != nil {
+			return "", nil, nil, err
+		}
+
+		hostKey, err := ssh.ParsePublicKey(hb.HostKey)
+		if err != nil {
+			return "", nil, nil, err
+		}
+
+		return req.User, req.SessionID, hostKey, nil
+	default:
+		return "", nil, nil, fmt.Errorf("unsupported userauth method %s", req.Method)
+	}
+}
+
+// parseDestConstraints parses the details of a restrict-destination-v00@openssh.com
+// constraint extension.
+func parseDestConstraints(details []byte) ([]destConstraint, error) {
+	var constraints []destConstraint
+
+	for len(details) > 0 {
+		var msg struct {
+			Constraint []byte
+			Rest       []byte `ssh:"rest"`
+		}
+
+		if err := ssh.Unmarshal(details, &msg); err != nil {
+			return nil, err
+		}
+
+		var c struct {
+			From     []byte
+			To       []byte
+			Reserved []byte
+		}
+
+		if err := ssh.Unmarshal(msg.Constraint, &c); err != nil {
+			return nil, err
+		}
+
+		if len(c.Reserved) != 0 {
+			return nil, errors.New("unsupported destination constraint extensions")
+		}
+
+		from, err := parseDestConstraintHop(c.From)
+		if err != nil {
+			return nil, err
+		}
+
+		to, err := parseDestConstraintHop(c.To)
+		if err != nil {
+			return nil, err
+		}
+
+		if from.user != "" {
+			return nil, errors.New("invalid destination constraint: user on from hop")
+		}
+
+		if to.hostname == "" {
+			return nil, errors.New("invalid destination constraint: missing to hostname")
+		}
+
+		constraints = append(constraints, destConstraint{from: from, to: to})
+		details = msg.Rest
+	}
+
+	return constraints, nil
+}
+
+func parseDestConstraintHop(data []byte) (destConstraintHop, error) {
+	var (
+		hop destConstraintHop
+		msg struct {
+			User     string
+			Hostname string
+			Reserved []byte
+			Rest     []byte `ssh:"rest"`
+		}
+	)
+
+	if err := ssh.Unmarshal(data, &msg); err != nil {
+		return hop, err
+	}
+
+	if len(msg.Reserved) != 0 {
+		return hop, errors.New("unsupported destination constraint hop extensions")
+	}
+
+	hop.user = msg.User
+	hop.hostname = msg.Hostname
+
+	for rest := msg.Rest; len(rest) > 0; {
+		var keyspec struct {
+			KeyBlob []byte
+			IsCA    bool
+			Rest    []byte `ssh:"rest"`
+		}
+
+		if err := ssh.Unmarshal(rest, &keyspec); err != nil {
+			return hop, err
+		}
+
+		key, err := ssh.ParsePublicKey(keyspec.KeyBlob)
+		if err != nil {
+			return hop, err
+		}
+
+		hop.keys = append(hop.keys, key)
+		hop.isCA = append(hop.isCA, keyspec.IsCA)
+		rest = keyspec.Rest
+	}
+
+	if hop.hostname != "" && len(hop.keys) == 0 {
+		return hop, fmt.Errorf("no host keys for destination %s", hop.hostname)
+	}
+
+	return hop, nil
+}
+
+// extensionPermitted checks that every forwarded hop of the connection is one
+// of the hosts listed in restrict.hosts before allowing the 42wim extensions.
+// Only hops bound with session-bind are known, a connection forwarded by a
+// client that doesn't send it has no bindings and isn't restricted. Local
+// clients don't send it either, so it can't be required.
+func (c *connAgent) extensionPermitted(extensionType string) error {
+	hosts := c.v.GetStringSlice("restrict.hosts")
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	var allowed []ssh.PublicKey
+
+	for _, host := range hosts {
+		keys, err := c.knownHostKeys(host)
+		if err != nil {
+			return err
+		}
+
+		allowed = append(allowed, keys...)
+	}
+
+	for _, b := range c.bindings {
+		if !b.forwarded {
+			continue
+		}
+
+		if !containsKey(allowed, b.hostKey) {
+			log.Printf("refusing %s from forwarded host %s\n", extensionType, ssh.FingerprintSHA256(b.hostKey))
+			return errNotPermitted
+		}
+	}
+
+	return nil
+}
+
+// knownHostKeys returns the host keys for host found in restrict.knownhosts
+// (~/.ssh/known_hosts by default).
+func (s *SSHAgent) knownHostKeys(host string) ([]ssh.PublicKey, error) {
+	files := s.v.GetStringSlice("restrict.knownhosts")
+	if len(files) == 0 {
+		files = []string{"~/.ssh/known_hosts"}
+	}
+
+	var keys []ssh.PublicKey
+
+	for _, file := range files {
+		data, err := os.ReadFile(expandHome(file))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		for len(data) > 0 {
+			marker, hosts, pk, _, rest, err := ssh.ParseKnownHosts(data)
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+
+			data = rest
+
+			if marker != "" {
+				continue
+			}
+
+			if matchKnownHost(hosts, host) {
+				keys = append(keys, pk)
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+// matchKnownHost matches host against the (hashed) host patterns of a
+// known_hosts line.
+func matchKnownHost(patterns []string, host string) bool {
+	matched := false
+
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "|1|") {
+			if matchHashedHost(p, host) {
+				matched = true
+			}
+
+			continue
+		}
+
+		if strings.HasPrefix(p, "!") {
+			if matchHostPattern(p[1:], host) {
+				return false
+			}
+
+			continue
+		}
+
+		if matchHostPattern(p, host) {
+			matched = true
+		}
+	}
+
+	return matched
+}
+
+func matchHashedHost(entry, host string) bool {
+	parts := strings.Split(entry[3:], "|")
+	if len(parts) != 2 {
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+
+	hash, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(strings.ToLower(host)))
+
+	return hmac.Equal(mac.Sum(nil), hash)
+}
+
+// matchPattern matches s against an OpenSSH style pattern, * matches any
+// characters and ? one character. Unlike path.Match there are no character
+// classes or escapes and / is an ordinary character, so [host]:port and
+// SHA256 fingerprints can be matched.
+func matchPattern(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			pattern = strings.TrimLeft(pattern, "*")
+			if pattern == "" {
+				return true
+			}
+
+			for i := 0; i <= len(s); i++ {
+				if matchPattern(pattern, s[i:]) {
+					return true
+				}
+			}
+
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+
+			_, n := utf8.DecodeRuneInString(s)
+			s, pattern = s[n:], pattern[1:]
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+
+			s, pattern = s[1:], pattern[1:]
+		}
+	}
+
+	return s == ""
+}
+
+// matchHostPattern matches host against a host pattern ignoring case, like
+// OpenSSH does.
+func matchHostPattern(pattern, host string) bool {
+	return matchPattern(strings.ToLower(pattern), strings.ToLower(host))
+}
+
+func containsKey(keys []ssh.PublicKey, key ssh.PublicKey) bool {
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"*", "", true},
+		{"*", "anything/at/all", true},
+		{"git", "git", true},
+		{"git", "gitx", false},
+		{"g?t", "git", true},
+		{"g?t", "gt", false},
+		{"g?t", "gét", true},
+		{"*.example.com", "build1.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"build?.example.com", "build12.example.com", false},
+		{"[gw.example.com]:2222", "[gw.example.com]:2222", true},
+		{"[gw.example.com]:*", "[gw.example.com]:2222", true},
+		{"[gw.example.com]:2222", "g:2222", false},
+		{"SHA256:abc*", "SHA256:abc/def+ghi", true},
+		{"SHA256:*/def*", "SHA256:abc/def+ghi", true},
+		{"/usr/bin/*", "/usr/bin/git", true},
+		{"/usr/*/git", "/usr/local/bin/git", true},
+		{"a**b", "ab", true},
+		{"a*b*c", "axxbxxc", true},
+		{"a*b*c", "axxbxx", false},
+		{"\\*", "*", false},
+		{"Git", "git", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchPattern(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func hashKnownHost(salt []byte, host string) string {
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+
+	return "|1|" + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestMatchKnownHost(t *testing.T) {
+	salt := []byte("0123456789abcdefghij")
+
+	tests := []struct {
+		patterns []string
+		host     string
+		want     bool
+	}{
+		{[]string{"build1.example.com"}, "build1.example.com", true},
+		{[]string{"build1.example.com"}, "BUILD1.Example.com", true},
+		{[]string{"Build1.Example.COM"}, "build1.example.com", true},
+		{[]string{"[gw.example.com]:2222"}, "[gw.example.com]:2222", true},
+		{[]string{"[gw.example.com]:2222"}, "gw.example.com", false},
+		{[]string{"*.example.com", "!evil.example.com"}, "build1.example.com", true},
+		{[]string{"*.example.com", "!evil.example.com"}, "evil.example.com", false},
+		{[]string{"!evil.example.com", "*.example.com"}, "EVIL.example.com", false},
+		{[]string{hashKnownHost(salt, "build1.example.com")}, "build1.example.com", true},
+		{[]string{hashKnownHost(salt, "build1.example.com")}, "Build1.example.com", true},
+		{[]string{hashKnownHost(salt, "[gw.example.com]:2222")}, "[gw.example.com]:2222", true},
+		{[]string{hashKnownHost(salt, "build1.example.com")}, "build2.example.com", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchKnownHost(tt.patterns, tt.host); got != tt.want {
+			t.Errorf("matchKnownHost(%q, %q) = %v, want %v", tt.patterns, tt.host, got, tt.want)
+		}
+	}
+}
+
+type testHop struct {
+	user     string
+	hostname string
+	keys     []ssh.PublicKey
+	ca       bool
+}
+
+// marshal encodes the hop like ssh-add -h does.
+func (h testHop) marshal() []byte {
+	var keyspecs []byte
+
+	for _, k := range h.keys {
+		keyspecs = append(keyspecs, ssh.Marshal(struct {
+			KeyBlob []byte
+			IsCA    bool
+		}{k.Marshal(), h.ca})...)
+	}
+
+	return ssh.Marshal(struct {
+		User     string
+		Hostname string
+		Reserved []byte
+		Rest     []byte `ssh:"rest"`
+	}{h.user, h.hostname, nil, keyspecs})
+}
+
+func testDestConstraint(from, to testHop, reserved []byte) []byte {
+	return ssh.Marshal(struct {
+		Constraint []byte
+	}{ssh.Marshal(struct {
+		From     []byte
+		To       []byte
+		Reserved []byte
+	}{from.marshal(), to.marshal(), reserved})})
+}
+
+func TestParseDestConstraints(t *testing.T) {
+	_, hk1 := testEd25519Key(t, 10)
+	_, hk2 := testEd25519Key(t, 11)
+
+	host1 := testHop{hostname: "host1", keys: []ssh.PublicKey{hk1}}
+	host2 := testHop{user: "git", hostname: "host2", keys: []ssh.PublicKey{hk1, hk2}, ca: true}
+
+	tests := []struct {
+		name    string
+		details []byte
+		n       int
+		ok      bool
+	}{
+		{"one hop", testDestConstraint(testHop{}, host1, nil), 1, true},
+		{"two hops", append(testDestConstraint(testHop{}, host1, nil), testDestConstraint(host1, host2, nil)...), 2, true},
+		{"empty", nil, 0, true},
+		{"user on from hop", testDestConstraint(testHop{user: "git", hostname: "host1", keys: []ssh.PublicKey{hk1}}, host2, nil), 0, false},
+		{"no to hostname", testDestConstraint(testHop{}, testHop{}, nil), 0, false},
+		{"no host keys", testDestConstraint(testHop{}, testHop{hostname: "host1"}, nil), 0, false},
+		{"reserved", testDestConstraint(testHop{}, host1, []byte("x")), 0, false},
+		{"truncated", testDestConstraint(testHop{}, host1, nil)[:20], 0, false},
+	}
+
+	for _, tt := range tests {
+		constraints, err := parseDestConstraints(tt.details)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: parseDestConstraints() error = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+
+		if len(constraints) != tt.n {
+			t.Errorf("%s: parseDestConstraints() = %d constraints, want %d", tt.name, len(constraints), tt.n)
+		}
+	}
+
+	constraints, err := parseDestConstraints(append(testDestConstraint(testHop{}, host1, nil), testDestConstraint(host1, host2, nil)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	to := constraints[1].to
+	if to.user != "git" || to.hostname != "host2" || len(to.keys) != 2 || !to.isCA[1] || constraints[1].from.hostname != "host1" {
+		t.Errorf("parseDestConstraints() = %+v", constraints[1])
+	}
+}
+
+// testUserauthRequest returns the data signed for a publickey userauth request,
+// with hostKey it uses the publickey-hostbound method.
+func testUserauthRequest(sessionID []byte, user string, pk, hostKey ssh.PublicKey) []byte {
+	method, rest := "publickey", []byte(nil)
+	if hostKey != nil {
+		method, rest = "publickey-hostbound-v00@openssh.com", ssh.Marshal(struct{ HostKey []byte }{hostKey.Marshal()})
+	}
+
+	return ssh.Marshal(struct {
+		SessionID []byte
+		Type      uint8
+		User      string
+		Service   string
+		Method    string
+		HasSig    bool
+		Algo      string
+		PubKey    []byte
+		Rest      []byte `ssh:"rest"`
+	}{sessionID, 50, user, "ssh-connection", method, true, pk.Type(), pk.Marshal(), rest})
+}
+
+func TestSignPermitted(t *testing.T) {
+	_, pk := testEd25519Key(t, 1)
+	_, other := testEd25519Key(t, 2)
+	_, hk1 := testEd25519Key(t, 10)
+	_, hk2 := testEd25519Key(t, 11)
+
+	s1, s2 := []byte("session1"), []byte("session2")
+
+	host1 := testHop{hostname: "host1", keys: []ssh.PublicKey{hk1}}
+	host2 := testHop{hostname: "host2", keys: []ssh.PublicKey{hk2}}
+
+	// ssh-add -h git@host1 -h "host1>host2"
+	destinations, err := parseDestConstraints(append(testDestConstraint(testHop{}, testHop{user: "git", hostname: "host1", keys: []ssh.PublicKey{hk1}}, nil), testDestConstraint(host1, host2, nil)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := &keyInfo{pk: pk, destinations: destinations}
+
+	direct := func(hk ssh.PublicKey, id []byte) []sessionBinding {
+		return []sessionBinding{{hostKey: hk, sessionID: id}}
+	}
+
+	forwarded := []sessionBinding{{hostKey: hk1, sessionID: s1, forwarded: true}, {hostKey: hk2, sessionID: s2}}
+
+	tests := []struct {
+		name     string
+		bindings []sessionBinding
+		data     []byte
+		ok       bool
+	}{
+		{"unbound", nil, testUserauthRequest(s1, "git", pk, nil), false},
+		{"host1", direct(hk1, s1), testUserauthRequest(s1, "git", pk, nil), true},
+		{"host1 hostbound", direct(hk1, s1), testUserauthRequest(s1, "git", pk, hk1), true},
+		{"host1 other user", direct(hk1, s1), testUserauthRequest(s1, "root", pk, nil), false},
+		{"host1 other session", direct(hk1, s1), testUserauthRequest(s2, "git", pk, nil), false},
+		{"host1 other hostkey", direct(hk1, s1), testUserauthRequest(s1, "git", pk, hk2), false},
+		{"host1 other key", direct(hk1, s1), testUserauthRequest(s1, "git", other, nil), false},
+		{"host2 directly", direct(hk2, s2), testUserauthRequest(s2, "git", pk, nil), false},
+		{"host2 through host1", forwarded, testUserauthRequest(s2, "root", pk, hk2), true},
+		{"host2 through host1 without hostkey", forwarded, testUserauthRequest(s2, "root", pk, nil), false},
+		{"host2 through host1 old session", forwarded, testUserauthRequest(s1, "root", pk, hk2), false},
+		{"not a userauth request", direct(hk1, s1), []byte("some data to sign"), false},
+	}
+
+	for _, tt := range tests {
+		c := &connAgent{bindings: tt.bindings}
+
+		if err := c.signPermitted(info, tt.data); (err == nil) != tt.ok {
+			t.Errorf("%s: signPermitted() error = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+// testSessionBind returns a session-bind@openssh.com request binding the session
+// id to the host key hostKey.
+func testSessionBind(t *testing.T, hostKey *ed25519.PrivateKey, id []byte, forwarding bool) []byte {
+	t.Helper()
+
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig, err := signer.Sign(rand.Reader, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ssh.Marshal(struct {
+		HostKey      []byte
+		SessionID    []byte
+		Signature    []byte
+		IsForwarding bool
+	}{signer.PublicKey().Marshal(), id, ssh.Marshal(sig), forwarding})
+}
+
+func TestGPGSignPermitted(t *testing.T) {
+	key, _ := testEd25519Key(t, 1)
+	host1Key, hk1 := testEd25519Key(t, 10)
+	host2Key, _ := testEd25519Key(t, 11)
+
+	s := newTestAgent(t, "[gpg.test]\nname=\"Test\"\nemail=\"test@example.com\"\nmatchcomment=\"test\"\n")
+
+	// ssh-add -h host1
+	if err := s.Add(agent.AddedKey{
+		PrivateKey: key,
+		Comment:    "test",
+		ConstraintExtensions: []agent.ConstraintExtension{{
+			ExtensionName:    restrictDestinationExtension,
+			ExtensionDetails: testDestConstraint(testHop{}, testHop{hostname: "host1", keys: []ssh.PublicKey{hk1}}, nil),
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	contents := testGPGSignRequest("Test <test@example.com>", []byte("data"))
+
+	tests := []struct {
+		name    string
+		hostKey *ed25519.PrivateKey
+		ok      bool
+	}{
+		{"unbound", nil, true},
+		{"host1", host1Key, true},
+		{"host2", host2Key, false},
+	}
+
+	for _, tt := range tests {
+		c := s.newConnAgent(nil)
+
+		if tt.hostKey != nil {
+			if _, err := c.Extension(sessionBindExtension, testSessionBind(t, tt.hostKey, []byte("session"), false)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, err := c.Extension(gpgSignExtension, contents)
+		if tt.ok && err != nil {
+			t.Errorf("%s: Extension() error = %v", tt.name, err)
+		}
+
+		if !tt.ok && !errors.Is(err, errNotPermitted) {
+			t.Errorf("%s: Extension() error = %v, want %v", tt.name, err, errNotPermitted)
+		}
+	}
+}
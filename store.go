@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const storeVersion = 1
+
+// scrypt parameters used for new stores.
+const (
+	storeScryptN = 1 << 15
+	storeScryptR = 8
+	storeScryptP = 1
+)
+
+// keyStore keeps the added keys in a passphrase encrypted file so they survive
+// a restart of the agent.
+type keyStore struct {
+	path  string
+	salt  []byte
+	key   []byte
+	mutex sync.Mutex
+}
+
+// storeFile is the on-disk format of the key store, data is the AES-256-GCM
+// encrypted JSON encoding of []storedKey.
+type storeFile struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	Salt    []byte `json:"salt"`
+	N       int    `json:"n"`
+	R       int    `json:"r"`
+	P       int    `json:"p"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+type storedKey struct {
+	PrivateKey  []byte                `json:"privatekey"`
+	Certificate []byte                `json:"certificate,omitempty"`
+	Comment     string                `json:"comment"`
+	Expire      *time.Time            `json:"expire,omitempty"`
+	Confirm     bool                  `json:"confirm,omitempty"`
+	Constraints []storedKeyConstraint `json:"constraints,omitempty"`
+}
+
+type storedKeyConstraint struct {
+	Name    string `json:"name"`
+	Details []byte `json:"details"`
+}
+
+func (s *SSHAgent) storePath() (string, error) {
+	if s.v.GetString("store.path") != "" {
+		return expandHome(s.v.GetString("store.path")), nil
+	}
+
+	cfgPath, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(cfgPath, agentName, "keys.store"), nil
+}
+
+// openStore unlocks the key store with a passphrase asked through pinentry and
+// adds the stored keys to the agent. A new store is created when it doesn't exist yet.
+func (s *SSHAgent) openStore() error {
+	path, err := s.storePath()
+	if err != nil {
+		return err
+	}
+
+	f, err := readStoreFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s.createStore(path)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	passphrase, err := getPassphrase("ssh-agentx key store", "Please enter the passphrase to unlock the key store "+path)
+	if err != nil {
+		return err
+	}
+
+	store, keys, err := f.open(path, passphrase)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		added, err := k.addedKey()
+		if err != nil {
+			log.Printf("%s: skipping key %s: %s\n", path, k.Comment, err)
+			continue
+		}
+
+		if k.Expire != nil && added.LifetimeSecs == 0 {
+			continue
+		}
+
+		if err := s.Add(added); err != nil {
+			if errors.Is(err, errFingerprintMismatch) {
+				return fmt.Errorf("%s: key %s: %w", path, k.Comment, err)
+			}
+
+			log.Printf("%s: adding key %s failed: %s\n", path, k.Comment, err)
+		}
+	}
+
+	log.Printf("restored %d keys from %s\n", len(keys), path)
+
+	s.store = store
+
+	// rewrite the store to get rid of expired keys.
+	s.saveStore()
+
+	return nil
+}
+
+func (s *SSHAgent) createStore(path string) error {
+	passphrase, err := getPassphrase("ssh-agentx key store", "Please enter a new passphrase for the key store "+path)
+	if err != nil {
+		return err
+	}
+
+	again, err := getPassphrase("ssh-agentx key store", "Please repeat the passphrase for the key store "+path)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(passphrase, again) {
+		return errors.New("key store passphrases do not match")
+	}
+
+	store, err := newKeyStore(path, passphrase)
+	if err != nil {
+		return err
+	}
+
+	s.store = store
+
+	s.saveStore()
+
+	log.Println("created key store", path)
+
+	return nil
+}
+
+func newKeyStore(path string, passphrase []byte) (*keyStore, error) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	key, err := scrypt.Key(passphrase, salt, storeScryptN, storeScryptR, storeScryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+
+	return &keyStore{
+		path: path,
+		salt: salt,
+		key:  key,
+	}, nil
+}
+
+func readStoreFile(path string) (*storeFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f storeFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if f.Version != storeVersion || f.KDF != "scrypt" {
+		return nil, fmt.Errorf("%s: unsupported store version %d (%s)", path, f.Version, f.KDF)
+	}
+
+	return &f, nil
+}
+
+// open decrypts the keys of the store file at path with passphrase.
+func (f *storeFile) open(path string, passphrase []byte) (*keyStore, []storedKey, error) {
+	key, err := scrypt.Key(passphrase, f.Salt, f.N, f.R, f.P, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plaintext, err := storeAEAD(key, func(aead cipher.AEAD) ([]byte, error) {
+		return aead.Open(nil, f.Nonce, f.Data, nil)
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: wrong passphrase or corrupted store", path)
+	}
+
+	var keys []storedKey
+	if err := json.Unmarshal(plaintext, &keys); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return &keyStore{
+		path: path,
+		salt: f.Salt,
+		key:  key,
+	}, keys, nil
+}
+
+// saveStore writes all keys currently in the agent to the key store.
+func (s *SSHAgent) saveStore() {
+	if s.store == nil {
+		return
+	}
+
+	// take the snapshot and write it under one lock, so an older snapshot
+	// can't overwrite a newer one.
+	s.store.mutex.Lock()
+	defer s.store.mutex.Unlock()
+
+	var keys []storedKey
+
+	s.keysMutex.RLock()
+	for _, info := range s.keys {
+		k, err := newStoredKey(info)
+		if err != nil {
+			log.Printf("not storing key %s: %s\n", info.comment, err)
+			continue
+		}
+
+		keys = append(keys, k)
+	}
+	s.keysMutex.RUnlock()
+
+	if err := s.store.write(keys); err != nil {
+		log.Println("saving key store failed:", err)
+	}
+}
+
+// write replaces the store with keys, the caller holds ks.mutex.
+func (ks *keyStore) write(keys []storedKey) error {
+	plaintext, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	ciphertext, err := storeAEAD(ks.key, func(aead cipher.AEAD) ([]byte, error) {
+		return aead.Seal(nil, nonce, plaintext, nil), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(storeFile{
+		Version: storeVersion,
+		KDF:     "scrypt",
+		Salt:    ks.salt,
+		N:       storeScryptN,
+		R:       storeScryptR,
+		P:       storeScryptP,
+		Nonce:   nonce,
+		Data:    ciphertext,
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp := ks.path + ".tmp"
+
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, ks.path)
+}
+
+func storeAEAD(key []byte, f func(cipher.AEAD) ([]byte, error)) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return f(aead)
+}
+
+func newStoredKey(info *keyInfo) (storedKey, error) {
+	block, err := ssh.MarshalPrivateKey(info.added.PrivateKey, info.comment)
+	if err != nil {
+		return storedKey{}, err
+	}
+
+	k := storedKey{
+		PrivateKey: pem.EncodeToMemory(block),
+		Comment:    info.comment,
+		Expire:     info.expire,
+		Confirm:    info.confirm,
+	}
+
+	if info.added.Certificate != nil {
+		k.Certificate = info.added.Certificate.Marshal()
+	}
+
+	for _, c := range info.added.ConstraintExtensions {
+		k.Constraints = append(k.Constraints, storedKeyConstraint{
+			Name:    c.ExtensionName,
+			Details: c.ExtensionDetails,
+		})
+	}
+
+	return k, nil
+}
+
+// addedKey converts a stored key back into an agent.AddedKey, the lifetime is
+// set to the remaining lifetime of the key.
+func (k storedKey) addedKey() (agent.AddedKey, error) {
+	privateKey, err := ssh.ParseRawPrivateKey(k.PrivateKey)
+	if err != nil {
+		return agent.AddedKey{}, err
+	}
+
+	added := agent.AddedKey{
+		PrivateKey:       privateKey,
+		Comment:          k.Comment,
+		ConfirmBeforeUse: k.Confirm,
+	}
+
+	if len(k.Certificate) > 0 {
+		pk, err := ssh.ParsePublicKey(k.Certificate)
+		if err != nil {
+			return agent.AddedKey{}, err
+		}
+
+		cert, ok := pk.(*ssh.Certificate)
+		if !ok {
+			return agent.AddedKey{}, errors.New("stored certificate is not a certificate")
+		}
+
+		added.Certificate = cert
+	}
+
+	if k.Expire != nil {
+		if remaining := time.Until(*k.Expire); remaining > time.Second {
+			added.LifetimeSecs = uint32(remaining / time.Second)
+		}
+	}
+
+	for _, c := range k.Constraints {
+		added.ConstraintExtensions = append(added.ConstraintExtensions, agent.ConstraintExtension{
+			ExtensionName:    c.Name,
+			ExtensionDetails: c.Details,
+		})
+	}
+
+	return added, nil
+}
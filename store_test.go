@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// newTestStoreAgent returns an agent saving its keys in a new store at path.
+func newTestStoreAgent(t *testing.T, path string, passphrase string) *SSHAgent {
+	t.Helper()
+
+	store, err := newKeyStore(path, []byte(passphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestAgent(t, "")
+	s.store = store
+
+	return s
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.store")
+
+	key, pk := testEd25519Key(t, 1)
+	certKey, certPK := testEd25519Key(t, 2)
+	_, hk := testEd25519Key(t, 10)
+
+	s := newTestStoreAgent(t, path, "passphrase")
+
+	added := []agent.AddedKey{
+		{PrivateKey: key, Comment: "plain", ConfirmBeforeUse: true, LifetimeSecs: 3600},
+		{PrivateKey: certKey, Certificate: testCertificate(t, certPK), Comment: "cert", ConstraintExtensions: []agent.ConstraintExtension{{
+			ExtensionName:    restrictDestinationExtension,
+			ExtensionDetails: testDestConstraint(testHop{}, testHop{hostname: "host1", keys: []ssh.PublicKey{hk}}, nil),
+		}}},
+	}
+
+	for _, k := range added {
+		if err := s.Add(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := readStoreFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, keys, err := f.open(path, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newTestAgent(t, "")
+
+	for _, k := range keys {
+		added, err := k.addedKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := restored.Add(added); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for blob, want := range s.keys {
+		got, ok := restored.keys[blob]
+		if !ok {
+			t.Errorf("key %s not restored", want.comment)
+			continue
+		}
+
+		if got.comment != want.comment || got.confirm != want.confirm || len(got.destinations) != len(want.destinations) || (got.expire == nil) != (want.expire == nil) {
+			t.Errorf("restored %+v, want %+v", got, want)
+		}
+	}
+
+	if len(restored.keys) != 2 {
+		t.Errorf("restored %d keys, want 2", len(restored.keys))
+	}
+
+	if _, ok := restored.keys[string(pk.Marshal())]; !ok {
+		t.Error("plain key not restored")
+	}
+
+	if err := s.Remove(pk); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = readStoreFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, keys, err = f.open(path, []byte("passphrase")); err != nil || len(keys) != 1 {
+		t.Errorf("store after Remove() has %d keys, error = %v", len(keys), err)
+	}
+}
+
+func TestStoreOpenInvalid(t *testing.T) {
+	tests := []struct {
+		name       string
+		passphrase string
+		change     func(f *storeFile)
+	}{
+		{"wrong passphrase", "wrong", func(f *storeFile) {}},
+		{"tampered data", "passphrase", func(f *storeFile) { f.Data[0] ^= 1 }},
+		{"tampered nonce", "passphrase", func(f *storeFile) { f.Nonce[0] ^= 1 }},
+		{"tampered salt", "passphrase", func(f *storeFile) { f.Salt[0] ^= 1 }},
+	}
+
+	key, _ := testEd25519Key(t, 1)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keys.store")
+
+			s := newTestStoreAgent(t, path, "passphrase")
+			if err := s.Add(agent.AddedKey{PrivateKey: key, Comment: "test"}); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err := readStoreFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tt.change(f)
+
+			if _, keys, err := f.open(path, []byte(tt.passphrase)); err == nil {
+				t.Errorf("open() = %d keys, want an error", len(keys))
+			}
+		})
+	}
+}
+
+func TestReadStoreFileInvalid(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, data := range []string{
+		`not json`,
+		`{"version":2,"kdf":"scrypt"}`,
+		`{"version":1,"kdf":"argon2"}`,
+	} {
+		path := filepath.Join(dir, "keys.store")
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := readStoreFile(path); err == nil {
+			t.Errorf("readStoreFile() accepted %s", data)
+		}
+	}
+
+	if _, err := readStoreFile(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("readStoreFile() of a missing file error = %v", err)
+	}
+}
+
+func TestSaveStoreLatest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.store")
+
+	s := newTestStoreAgent(t, path, "passphrase")
+
+	done := make(chan error)
+
+	for i := 0; i < 8; i++ {
+		key, _ := testEd25519Key(t, byte(i+1))
+
+		go func() {
+			done <- s.Add(agent.AddedKey{PrivateKey: key})
+		}()
+	}
+
+	for i := 0; i < 8; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := readStoreFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, keys, err := f.open(path, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the last write has every key
+	if len(keys) != 8 {
+		t.Errorf("store has %d keys, want 8", len(keys))
+	}
+
+	if bytes.Contains(f.Data, []byte("PRIVATE KEY")) {
+		t.Error("store isn't encrypted")
+	}
+}
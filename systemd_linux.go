@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd, see sd_listen_fds(3).
+const listenFdsStart = 3
+
+// socketActivated returns true if systemd passed us sockets.
+func socketActivated() bool {
+	return os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) && os.Getenv("LISTEN_FDS") != ""
+}
+
+// systemdListeners returns the listening sockets passed by systemd socket
+// activation. A socket named ssh-agentx (FileDescriptorName=) is returned first
+// and used for SSH_AUTH_SOCK.
+func systemdListeners() []net.Listener {
+	if !socketActivated() {
+		return nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		log.Println("invalid LISTEN_FDS:", os.Getenv("LISTEN_FDS"))
+		return nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []net.Listener
+
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+
+		l, err := net.FileListener(f)
+		f.Close()
+
+		if err != nil {
+			log.Println("ignoring socket", name, "from systemd:", err)
+			continue
+		}
+
+		log.Println("using socket", name, "from systemd:", l.Addr())
+
+		if name == agentName {
+			listeners = append([]net.Listener{l}, listeners...)
+		} else {
+			listeners = append(listeners, l)
+		}
+	}
+
+	return listeners
+}
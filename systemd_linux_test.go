@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestSocketActivated(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+
+	tests := []struct {
+		listenPid string
+		listenFds string
+		want      bool
+	}{
+		{pid, "1", true},
+		{pid, "", false},
+		{"1", "1", false},
+		{"", "1", false},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("LISTEN_PID", tt.listenPid)
+		t.Setenv("LISTEN_FDS", tt.listenFds)
+
+		if got := socketActivated(); got != tt.want {
+			t.Errorf("socketActivated() with LISTEN_PID=%s LISTEN_FDS=%s = %v, want %v", tt.listenPid, tt.listenFds, got, tt.want)
+		}
+	}
+}
@@ -21,6 +21,9 @@ type YubiKey struct {
 	serial        uint32
 }
 
+// ErrUnsupportedSlot is returned for slots that can't be used for signing.
+var ErrUnsupportedSlot = errors.New("unsupported slot-id")
+
 var (
 	pivCards = piv.Cards
 	pivMap   sync.Map
@@ -92,6 +95,17 @@ func (k *YubiKey) GetSlot() string {
 	return k.slot
 }
 
+// Connected checks if the YubiKey still responds.
+func (k *YubiKey) Connected() bool {
+	_, err := k.yk.Serial()
+	return err == nil
+}
+
+// Serial returns the serial number of the YubiKey.
+func (k *YubiKey) Serial() uint32 {
+	return k.serial
+}
+
 // GetPublicKey returns the public key present in the YubiKey signature slot.
 func (k *YubiKey) GetPublicKey() (crypto.PublicKey, error) {
 	slot, err := getSlot(k.slot)
@@ -149,6 +163,23 @@ func (k *YubiKey) Close() error {
 	return nil
 }
 
+// Reopen closes the connection to the YubiKey and opens it again, the card
+// forgets the PIN that was verified on the old connection.
+func (k *YubiKey) Reopen() error {
+	if err := k.Close(); err != nil {
+		return err
+	}
+
+	yk, err := openCard(k.card)
+	if err != nil {
+		return errors.Wrap(err, "error opening yubikey")
+	}
+
+	k.yk = yk
+
+	return nil
+}
+
 // means that the key was generated in the device. If not we'll try to get the
 // key from a stored certificate in the same slot.
 func (k *YubiKey) getPublicKey(slot piv.Slot) (crypto.PublicKey, error) {
@@ -194,7 +225,7 @@ var slotMapping = map[string]piv.Slot{
 func getSlot(name string) (piv.Slot, error) {
 	s, ok := slotMapping[name]
 	if !ok {
-		return piv.Slot{}, errors.Errorf("unsupported slot-id '%s'", name)
+		return piv.Slot{}, fmt.Errorf("%w '%s'", ErrUnsupportedSlot, name)
 	}
 
 	return s, nil
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+var errWindowClosed = errors.New("agent: yubikey signing window is closed")
+
+// handleYubiWindow opens the yubikey signing window for the duration in
+// contents or closes it when contents is "close". Requests that don't come
+// from ssh-agentx run locally by the same user must be confirmed.
+func (s *SSHAgent) handleYubiWindow(peer *peerCred, contents []byte) error {
+	if s.yubikey == nil {
+		return fmt.Errorf("yubikey support is not enabled")
+	}
+
+	if string(contents) == "close" {
+		log.Println("closing yubikey signing window requested by", peer)
+		return s.closeYubiWindow()
+	}
+
+	d, err := parseLifetime(string(contents))
+	if err != nil {
+		return fmt.Errorf("invalid signing window %s: %w", contents, err)
+	}
+
+	if max := s.v.GetDuration("yubikey.maxwindow"); max > 0 && d > max {
+		return fmt.Errorf("signing window %s is longer than %s", d, max)
+	}
+
+	if !isLocalPeer(peer) {
+		if err := s.confirm(fmt.Sprintf("Open the yubikey signing window for %s?\nRequested by %s.", d, peer)); err != nil {
+			return err
+		}
+	}
+
+	s.openYubiWindow(d)
+
+	log.Printf("yubikey signing window opened for %s by %s\n", d, peer)
+
+	return nil
+}
+
+func (s *SSHAgent) openYubiWindow(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.yubiWindowTimer != nil {
+		s.yubiWindowTimer.Stop()
+	}
+
+	s.yubiWindow = time.Now().Add(d)
+	s.yubiWindowTimer = time.AfterFunc(d, s.expireYubiWindow)
+}
+
+func (s *SSHAgent) expireYubiWindow() {
+	s.mutex.RLock()
+	expired := !s.yubiWindow.IsZero() && !time.Now().Before(s.yubiWindow)
+	s.mutex.RUnlock()
+
+	if !expired {
+		return
+	}
+
+	log.Println("yubikey signing window expired")
+
+	if err := s.closeYubiWindow(); err != nil {
+		log.Println("closing yubikey signing window failed:", err)
+	}
+}
+
+// closeYubiWindow closes the signing window and reopens the card so the
+// cached PIN is dropped.
+func (s *SSHAgent) closeYubiWindow() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.yubiWindowTimer != nil {
+		s.yubiWindowTimer.Stop()
+		s.yubiWindowTimer = nil
+	}
+
+	s.yubiWindow = time.Time{}
+
+	// without a yubikey there is no cached PIN to drop
+	if s.yubikey == nil {
+		return nil
+	}
+
+	if err := s.yubikey.Reopen(); err != nil {
+		return err
+	}
+
+	var err error
+
+	s.yubisigner, err = s.yubikey.CreateSigner()
+
+	return err
+}
+
+// yubiWindowOpen returns errWindowClosed when signing windows are enabled and
+// the window isn't open. Must be called with s.mutex held.
+func (s *SSHAgent) yubiWindowOpen() error {
+	if !s.v.GetBool("yubikey.window") {
+		return nil
+	}
+
+	if s.yubiWindow.IsZero() || !time.Now().Before(s.yubiWindow) {
+		return errWindowClosed
+	}
+
+	return nil
+}
+
+// runYubikey implements the yubikey subcommand.
+func runYubikey(args []string) int {
+	fs := flag.NewFlagSet(agentName+" yubikey", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s yubikey open duration\n", agentName)
+		fmt.Fprintf(fs.Output(), "       %s yubikey close\n", agentName)
+	}
+
+	fs.Parse(args)
+
+	var contents string
+
+	switch {
+	case fs.NArg() == 2 && fs.Arg(0) == "open":
+		contents = fs.Arg(1)
+	case fs.NArg() == 1 && fs.Arg(0) == "close":
+		contents = "close"
+	default:
+		fs.Usage()
+		return 2
+	}
+
+	if _, err := agentExtension(yubiWindowExtension, []byte(contents)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/42wim/ssh-agentx/yubikey"
+)
+
+func TestYubiWindow(t *testing.T) {
+	s := newTestAgent(t, "[yubikey]\nwindow=true")
+
+	if err := s.yubiWindowOpen(); !errors.Is(err, errWindowClosed) {
+		t.Fatalf("yubiWindowOpen() before opening error = %v, want %v", err, errWindowClosed)
+	}
+
+	s.openYubiWindow(time.Hour)
+
+	if err := s.yubiWindowOpen(); err != nil {
+		t.Fatalf("yubiWindowOpen() after opening error = %v", err)
+	}
+
+	// the timer of an earlier, shorter window doesn't close it
+	s.expireYubiWindow()
+
+	if err := s.yubiWindowOpen(); err != nil {
+		t.Fatalf("yubiWindowOpen() after an early timer error = %v", err)
+	}
+
+	if err := s.closeYubiWindow(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.yubiWindowOpen(); !errors.Is(err, errWindowClosed) {
+		t.Errorf("yubiWindowOpen() after closing error = %v, want %v", err, errWindowClosed)
+	}
+
+	if s.yubiWindowTimer != nil {
+		t.Error("closeYubiWindow() didn't stop the timer")
+	}
+
+	if err := newTestAgent(t, "").yubiWindowOpen(); err != nil {
+		t.Errorf("yubiWindowOpen() without windows error = %v", err)
+	}
+}
+
+func TestYubiWindowExpiry(t *testing.T) {
+	s := newTestAgent(t, "[yubikey]\nwindow=true")
+
+	s.openYubiWindow(50 * time.Millisecond)
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		s.mutex.RLock()
+		expired := s.yubiWindow.IsZero()
+		s.mutex.RUnlock()
+
+		if expired {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("the signing window didn't expire")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.mutex.RLock()
+	err := s.yubiWindowOpen()
+	s.mutex.RUnlock()
+
+	if !errors.Is(err, errWindowClosed) {
+		t.Errorf("yubiWindowOpen() after expiry error = %v, want %v", err, errWindowClosed)
+	}
+}
+
+func TestHandleYubiWindow(t *testing.T) {
+	withoutPinentry(t)
+
+	local := testLocalPeer(t)
+
+	forwarded := *local
+	forwarded.session = "0123456789abcdef"
+
+	if err := newTestAgent(t, "").handleYubiWindow(local, []byte("1h")); err == nil {
+		t.Error("handleYubiWindow() without a yubikey didn't fail")
+	}
+
+	tests := []struct {
+		name     string
+		peer     *peerCred
+		contents string
+		err      error
+		open     bool
+	}{
+		{"local", local, "1h", nil, true},
+		{"forwarded", &forwarded, "1h", errNotConfirmed, false},
+		{"unknown peer", nil, "1h", errNotConfirmed, false},
+		{"other executable", &peerCred{uid: os.Getuid(), exe: "/usr/bin/ssh"}, "1h", errNotConfirmed, false},
+	}
+
+	for _, tt := range tests {
+		s := newTestAgent(t, "[yubikey]\nwindow=true")
+		s.yubikey = &yubikey.YubiKey{}
+
+		if err := s.handleYubiWindow(tt.peer, []byte(tt.contents)); !errors.Is(err, tt.err) {
+			t.Errorf("%s: handleYubiWindow() error = %v, want %v", tt.name, err, tt.err)
+		}
+
+		if open := s.yubiWindowOpen() == nil; open != tt.open {
+			t.Errorf("%s: window open = %v, want %v", tt.name, open, tt.open)
+		}
+	}
+
+	s := newTestAgent(t, "[yubikey]\nwindow=true\nmaxwindow=\"1h\"")
+	s.yubikey = &yubikey.YubiKey{}
+
+	for _, contents := range []string{"2h", "forever"} {
+		if err := s.handleYubiWindow(local, []byte(contents)); err == nil {
+			t.Errorf("handleYubiWindow(%s) didn't fail", contents)
+		}
+	}
+}